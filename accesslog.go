@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Formats of web.access_log.
+const (
+	accessLogJSON   = "json"
+	accessLogLogfmt = "logfmt"
+)
+
+// reRequestId matches the X-Request-Id values accepted from clients, others
+// are replaced by a generated id.
+var reRequestId = regexp.MustCompile(`^[\w.:@/+=-]{1,128}$`)
+
+// responseRecorder records what is written to a response for metrics and
+// access logs.
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	rows      int64
+	requestId string
+}
+
+func (this *responseRecorder) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *responseRecorder) Write(b []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	return this.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying response writer.
+func (this *responseRecorder) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// statusCode returns the status of the response, 200 when none is written.
+func (this *responseRecorder) statusCode() int {
+	if this.status == 0 {
+		return http.StatusOK
+	}
+	return this.status
+}
+
+// setRows records the rows returned or affected by the request answered by w.
+func setRows(w http.ResponseWriter, rows int64) {
+	if recorder, ok := w.(*responseRecorder); ok {
+		recorder.rows = rows
+	}
+}
+
+// countRows returns the rows returned or affected by result. script tells
+// whether result is the result of a script, and list whether it is a list of
+// table records.
+func countRows(result any, script bool, list bool) int64 {
+	switch v := result.(type) {
+	case []map[string]any:
+		return int64(len(v))
+	case map[string]int64:
+		return v["rows_affected"]
+	case map[string]any:
+		if script {
+			var rows int64
+			for _, labeled := range v {
+				rows += countRows(labeled, false, false)
+			}
+			return rows
+		}
+		if data, ok := v["data"].([]map[string]any); ok && list {
+			return int64(len(data))
+		}
+		if rowsAffected, ok := v["rows_affected"].(int64); ok {
+			return rowsAffected
+		}
+		return 1
+	}
+	return 0
+}
+
+// requestId returns the X-Request-Id of r if it is valid, or a new random id.
+func requestId(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); reRequestId.MatchString(id) {
+		return id
+	}
+	return rand.Text()
+}
+
+// requestToken returns the token of the authorization header of r, without the
+// bearer scheme.
+func requestToken(r *http.Request) string {
+	authorization := r.Header.Get("authorization")
+	if strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		authorization = strings.TrimSpace(authorization[7:])
+	}
+	return authorization
+}
+
+// tokenFingerprint identifies token in logs without revealing it.
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+func newAccessLogger(format string) *slog.Logger {
+	switch format {
+	case accessLogJSON:
+		return slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	case accessLogLogfmt:
+		return slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	return nil
+}
+
+// finishRequest counts and logs the request r, answered by recorder since
+// start.
+func (this *App) finishRequest(recorder *responseRecorder, r *http.Request, start time.Time) {
+	duration := time.Since(start)
+	if this.Web.Metrics {
+		this.countRequest(recorder, r, duration)
+	}
+	if this.accessLogger != nil {
+		this.accessLogger.LogAttrs(r.Context(), slog.LevelInfo, "access",
+			slog.String("request_id", recorder.requestId),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("db", r.PathValue("db")),
+			slog.String("object", r.PathValue("obj")),
+			slog.String("method", r.Method),
+			slog.Int("status", recorder.statusCode()),
+			slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+			slog.Int64("rows", recorder.rows),
+			slog.String("token", tokenFingerprint(requestToken(r))),
+		)
+	}
+}
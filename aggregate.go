@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// aggregateFunctions are the functions allowed in .aggregate.
+var aggregateFunctions = map[string]string{
+	"count": "COUNT",
+	"sum":   "SUM",
+	"avg":   "AVG",
+	"min":   "MIN",
+	"max":   "MAX",
+}
+
+var reAggregate = regexp.MustCompile(`^(?:([^:]+):)?\s*(\w+)\s*\(\s*([^()]+?)\s*\)$`)
+
+// grouping is the GROUP BY columns and the aggregates of a grouped list.
+type grouping struct {
+	groupBy    []string
+	aggregates []string
+	aliases    []string
+}
+
+// parseGrouping parses .group_by, comma separated columns, and .aggregate,
+// comma separated functions such as count(*) or sum(amount), each optionally
+// aliased as alias:sum(amount). allowedColumns are the columns that can be
+// grouped and aggregated, or nil for all columns of the table.
+func (this *Database) parseGrouping(table *Table, groupByParam string, aggregateParam string, allowedColumns []string) (*grouping, error) {
+	if len(allowedColumns) == 0 {
+		var err error
+		allowedColumns, err = this.TableColumns(table)
+		if err != nil {
+			return nil, err
+		}
+	}
+	g := &grouping{}
+	for column := range strings.SplitSeq(groupByParam, ",") {
+		column = strings.TrimSpace(column)
+		if column == "" {
+			continue
+		}
+		if !reColumnName.MatchString(column) || !columnAllowed(allowedColumns, column) {
+			return nil, badRequest("invalid group by column %s", column)
+		}
+		g.groupBy = append(g.groupBy, column)
+	}
+	for item := range strings.SplitSeq(aggregateParam, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		m := reAggregate.FindStringSubmatch(item)
+		if m == nil {
+			return nil, badRequest("invalid aggregate %s", item)
+		}
+		alias, function, column := strings.TrimSpace(m[1]), strings.ToLower(m[2]), m[3]
+		sqlFunction, ok := aggregateFunctions[function]
+		if !ok {
+			return nil, badRequest("aggregate function %s is not allowed", function)
+		}
+		if column == "*" {
+			if function != "count" {
+				return nil, badRequest("invalid aggregate %s", item)
+			}
+		} else if !reColumnName.MatchString(column) || !columnAllowed(allowedColumns, column) {
+			return nil, badRequest("invalid aggregate column %s", column)
+		}
+		if alias == "" {
+			alias = function
+			if column != "*" {
+				alias = function + "_" + column
+			}
+		}
+		if !reColumnName.MatchString(alias) {
+			return nil, badRequest("invalid aggregate alias %s", alias)
+		}
+		g.aggregates = append(g.aggregates, sqlFunction+"("+column+") AS "+alias)
+		g.aliases = append(g.aliases, alias)
+	}
+	if len(g.groupBy) == 0 && len(g.aggregates) == 0 {
+		return nil, badRequest("no columns to group by or aggregate")
+	}
+	return g, nil
+}
+
+// columns returns the projection of the grouped list.
+func (this *grouping) columns() string {
+	return strings.Join(slices.Concat(this.groupBy, this.aggregates), ", ")
+}
+
+// groupByClause returns the GROUP BY clause, or an empty string when all
+// records are aggregated together.
+func (this *grouping) groupByClause() string {
+	if len(this.groupBy) == 0 {
+		return ""
+	}
+	return "GROUP BY " + strings.Join(this.groupBy, ", ")
+}
+
+// checkOrder rejects order columns that are neither grouped nor aliases of
+// aggregates.
+func (this *grouping) checkOrder(order []*orderColumn) error {
+	for _, c := range order {
+		matches := func(column string) bool { return strings.EqualFold(column, c.Column) }
+		if !slices.ContainsFunc(this.groupBy, matches) && !slices.ContainsFunc(this.aliases, matches) {
+			return badRequest("invalid order by column %s", c.Column)
+		}
+	}
+	return nil
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -86,11 +92,13 @@ func (this *APITestSuite) testAPI(usePatch bool) {
 	req, err := http.NewRequest(scriptMethod, this.baseURL+"test_db/init/", bytes.NewBuffer([]byte(`{"low": 0,"high": 3}`)))
 	this.Nil(err)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-Id", "init-request")
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	this.Nil(err)
 	defer resp.Body.Close()
 	this.Assert().Equal("123", resp.Header.Get("abc"))
+	this.Assert().Equal("init-request", resp.Header.Get("X-Request-Id"))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode)
 	body, err := io.ReadAll(resp.Body)
 	this.Nil(err)
@@ -107,6 +115,7 @@ func (this *APITestSuite) testAPI(usePatch bool) {
 	resp, err = http.Get(this.baseURL + "test_db/test_table/1")
 	this.Nil(err)
 	defer resp.Body.Close()
+	this.Assert().NotEmpty(resp.Header.Get("X-Request-Id"))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode)
 	body, err = io.ReadAll(resp.Body)
 	this.Nil(err)
@@ -202,6 +211,280 @@ func (this *APITestSuite) testAPI(usePatch bool) {
 	this.Nil(err)
 	this.Assert().Equal(1, int(respBody5["rows_affected"].(float64)))
 
+	// bulk post
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/test_table/", bytes.NewBuffer([]byte(`[{"id": 6,"name": "Delta"},{"id": 7,"name": "Epsilon"}]`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyBulkPost map[string]any
+	err = json.Unmarshal(body, &respBodyBulkPost)
+	this.Nil(err)
+	this.Assert().Equal(2, int(respBodyBulkPost["rows_affected"].(float64)))
+	this.Assert().Equal([]any{6.0, 7.0}, respBodyBulkPost["keys"])
+
+	// bulk post with a duplicate key, get the index of the failing row
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/test_table/", bytes.NewBuffer([]byte(`[{"id": 8,"name": "Zeta"},{"id": 1,"name": "Alpha"}]`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusInternalServerError, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyBulkError map[string]any
+	err = json.Unmarshal(body, &respBodyBulkError)
+	this.Nil(err)
+	this.Assert().Equal(1, int(respBodyBulkError["index"].(float64)))
+
+	// bulk put with an object and a key
+	req, err = http.NewRequest("PUT", this.baseURL+"test_db/test_table/?name=Theta", bytes.NewBuffer([]byte(`[{"id": 6,"name": "Eta"}, 7]`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyBulkPut map[string]any
+	err = json.Unmarshal(body, &respBodyBulkPut)
+	this.Nil(err)
+	this.Assert().Equal(2, int(respBodyBulkPut["rows_affected"].(float64)))
+
+	// bulk delete, the failed bulk post was rolled back
+	req, err = http.NewRequest("DELETE", this.baseURL+"test_db/test_table/", bytes.NewBuffer([]byte(`[6, 7, 8]`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyBulkDelete map[string]any
+	err = json.Unmarshal(body, &respBodyBulkDelete)
+	this.Nil(err)
+	this.Assert().Equal(2, int(respBodyBulkDelete["rows_affected"].(float64)))
+
+	// upsert an existing and a new record
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/test_table/?.upsert=true", bytes.NewBuffer([]byte(`[{"id": 3,"name": "Gamma"},{"id": 9,"name": "Iota"}]`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyUpsert map[string]any
+	err = json.Unmarshal(body, &respBodyUpsert)
+	this.Nil(err)
+	this.Assert().Equal(2, int(respBodyUpsert["rows_affected"].(float64)))
+
+	// delete the upserted record
+	req, err = http.NewRequest("DELETE", this.baseURL+"test_db/test_table/9", nil)
+	this.Nil(err)
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+
+	// post and return the record
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/test_table/", bytes.NewBuffer([]byte(`{"id": 10,"name": "Kappa"}`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Equal("return=representation", resp.Header.Get("Preference-Applied"))
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyReturning map[string]any
+	err = json.Unmarshal(body, &respBodyReturning)
+	this.Nil(err)
+	this.Assert().Equal(10, int(respBodyReturning["id"].(float64)))
+	this.Assert().Equal("Kappa", respBodyReturning["name"])
+
+	// reads and scripts return no written record
+	for _, url := range []string{"test_db/test_table/10", "test_db/list_tables/"} {
+		req, err = http.NewRequest("GET", this.baseURL+url, nil)
+		this.Nil(err)
+		req.Header.Set("Prefer", "return=representation")
+		resp, err = client.Do(req)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		this.Assert().Empty(resp.Header.Get("Preference-Applied"))
+	}
+
+	// put and return the record
+	req, err = http.NewRequest("PUT", this.baseURL+"test_db/test_table/10?.returning=true", bytes.NewBuffer([]byte(`{"name": "Lambda"}`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyPutReturning map[string]any
+	err = json.Unmarshal(body, &respBodyPutReturning)
+	this.Nil(err)
+	this.Assert().Equal("Lambda", respBodyPutReturning["name"])
+
+	// delete the returned record
+	req, err = http.NewRequest("DELETE", this.baseURL+"test_db/test_table/10", nil)
+	this.Nil(err)
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+
+	// get the first page with a cursor
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/?.cursor=&.page_size=1&.order_by=PRODUCT%20DESC")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyCursor map[string]any
+	err = json.Unmarshal(body, &respBodyCursor)
+	this.Nil(err)
+	this.Assert().Equal(1, len(respBodyCursor["data"].([]any)))
+	this.Assert().Equal("Banana", respBodyCursor["data"].([]any)[0].(map[string]any)["product"])
+	nextCursor, ok := respBodyCursor["next_cursor"].(string)
+	this.Assert().True(ok)
+
+	// get the next page with the cursor
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/?.page_size=1&.order_by=PRODUCT%20DESC&.cursor=" + nextCursor)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyNextCursor map[string]any
+	err = json.Unmarshal(body, &respBodyNextCursor)
+	this.Nil(err)
+	this.Assert().Equal(1, len(respBodyNextCursor["data"].([]any)))
+	this.Assert().Equal("Apple", respBodyNextCursor["data"].([]any)[0].(map[string]any)["product"])
+	this.Assert().Nil(respBodyNextCursor["next_cursor"])
+
+	// page through a table that does not export its key, with a NULL in the
+	// order column
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/test_table", strings.NewReader(`{"ID": 20, "NAME": null}`))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?.order_by=NAME&.page_size=1000")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	var allRows []map[string]any
+	err = json.NewDecoder(resp.Body).Decode(&allRows)
+	this.Nil(err)
+	pagedRows := []map[string]any{}
+	pageCursor := ""
+	for range len(allRows) + 1 {
+		resp, err = http.Get(this.baseURL + "test_db/test_table/?.order_by=NAME&.page_size=1&.cursor=" + pageCursor)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		var page struct {
+			Data       []map[string]any `json:"data"`
+			NextCursor *string          `json:"next_cursor"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		this.Nil(err)
+		pagedRows = append(pagedRows, page.Data...)
+		if page.NextCursor == nil {
+			break
+		}
+		pageCursor = *page.NextCursor
+	}
+	this.Assert().Equal(allRows, pagedRows)
+	req, err = http.NewRequest("DELETE", this.baseURL+"test_db/test_table/20", nil)
+	this.Nil(err)
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+
+	// use the cursor with another order and get 400
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/?.page_size=1&.order_by=PRODUCT&.cursor=" + nextCursor)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// get by composite key
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/1,2")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyLine map[string]any
+	err = json.Unmarshal(body, &respBodyLine)
+	this.Nil(err)
+	this.Assert().Equal("Banana", respBodyLine["product"])
+
+	// get by matrix-style composite key
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/ORDER_ID=1;LINE_NO=1")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyMatrix map[string]any
+	err = json.Unmarshal(body, &respBodyMatrix)
+	this.Nil(err)
+	this.Assert().Equal("Apple", respBodyMatrix["product"])
+
+	// get with an incomplete composite key and get 400
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/1")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// put by composite key in query parameters
+	req, err = http.NewRequest("PUT", this.baseURL+"test_db/order_lines/?order_id=1&line_no=2", bytes.NewBuffer([]byte(`{"product": "Cherry"}`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyLinePut map[string]any
+	err = json.Unmarshal(body, &respBodyLinePut)
+	this.Nil(err)
+	this.Assert().Equal(1, int(respBodyLinePut["rows_affected"].(float64)))
+
+	// delete by composite key
+	req, err = http.NewRequest("DELETE", this.baseURL+"test_db/order_lines/1,2", nil)
+	this.Nil(err)
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyLineDelete map[string]any
+	err = json.Unmarshal(body, &respBodyLineDelete)
+	this.Nil(err)
+	this.Assert().Equal(1, int(respBodyLineDelete["rows_affected"].(float64)))
+
 	// get page
 	resp, err = http.Get(this.baseURL + "test_db/test_table/?.page_size=2&.offset=1&.show_total=1")
 	this.Nil(err)
@@ -218,6 +501,301 @@ func (this *APITestSuite) testAPI(usePatch bool) {
 	this.Assert().Equal(2, len(respBody6["data"].([]any)))
 	this.Assert().Equal("Beta", respBody6["data"].([]any)[0].(map[string]any)["name"].(string))
 	this.Assert().Equal("Gamma", respBody6["data"].([]any)[1].(map[string]any)["name"].(string))
+	// get with filter operators
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?name.like=%25a&name.ne=Alpha&.order_by=NAME")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyFilter []any
+	err = json.Unmarshal(body, &respBodyFilter)
+	this.Nil(err)
+	this.Assert().Equal(2, len(respBodyFilter))
+	this.Assert().Equal("Beta", respBodyFilter[0].(map[string]any)["name"].(string))
+	this.Assert().Equal("Gamma", respBodyFilter[1].(map[string]any)["name"].(string))
+
+	// order by a descending column
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?.order_by=-name")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyOrder []any
+	err = json.Unmarshal(body, &respBodyOrder)
+	this.Nil(err)
+	this.Assert().Equal("Gamma", respBodyOrder[0].(map[string]any)["name"].(string))
+
+	// order by an unknown column or an expression and get 400
+	for _, orderBy := range []string{"password", "name%20collate%20nocase", "name;"} {
+		resp, err = http.Get(this.baseURL + "test_db/test_table/?.order_by=" + orderBy)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// select and alias columns of a list and a record
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?.select=username:name&.order_by=name")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodySelect []map[string]any
+	err = json.Unmarshal(body, &respBodySelect)
+	this.Nil(err)
+	this.Assert().Equal([]map[string]any{{"username": "Alpha"}, {"username": "Beta"}, {"username": "Gamma"}}, respBodySelect)
+
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/1,1?.select=line:line_no,product")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodySelectRecord map[string]any
+	err = json.Unmarshal(body, &respBodySelectRecord)
+	this.Nil(err)
+	this.Assert().Equal(map[string]any{"line": float64(1), "product": "Apple"}, respBodySelectRecord)
+
+	// select a column that is not exported or not in the table and get 400
+	for _, url := range []string{"test_db/test_table/?.select=id", "test_db/order_lines/1,1?.select=price"} {
+		resp, err = http.Get(this.baseURL + url)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// embed the lines of the orders
+	resp, err = http.Get(this.baseURL + "test_db/orders/?.embed=lines&.order_by=id")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyEmbed []map[string]any
+	err = json.Unmarshal(body, &respBodyEmbed)
+	this.Nil(err)
+	this.Assert().Equal(2, len(respBodyEmbed))
+	this.Assert().Equal(1, len(respBodyEmbed[0]["lines"].([]any)))
+	this.Assert().Equal("Apple", respBodyEmbed[0]["lines"].([]any)[0].(map[string]any)["product"])
+	this.Assert().Equal([]any{}, respBodyEmbed[1]["lines"])
+
+	resp, err = http.Get(this.baseURL + "test_db/orders/1?.embed=lines")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyEmbedRecord map[string]any
+	err = json.Unmarshal(body, &respBodyEmbedRecord)
+	this.Nil(err)
+	this.Assert().Equal("Acme", respBodyEmbedRecord["customer"])
+	this.Assert().Equal(1, len(respBodyEmbedRecord["lines"].([]any)))
+
+	// embed an unknown relation, or without the primary key, and get 400
+	for _, url := range []string{"test_db/orders/?.embed=items", "test_db/orders/?.embed=lines&.select=customer"} {
+		resp, err = http.Get(this.baseURL + url)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// group and aggregate the filtered records
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?name.like=%25a&name.ne=Alpha&.group_by=name&.aggregate=count(*),n:count(name)&.order_by=-name&.show_total=1")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyGroup map[string]any
+	err = json.Unmarshal(body, &respBodyGroup)
+	this.Nil(err)
+	this.Assert().Equal(2, int(respBodyGroup["total"].(float64)))
+	this.Assert().Equal([]any{
+		map[string]any{"name": "Gamma", "count": float64(1), "n": float64(1)},
+		map[string]any{"name": "Beta", "count": float64(1), "n": float64(1)},
+	}, respBodyGroup["data"])
+
+	// aggregate a column that is not exported, with a function that is not
+	// allowed, or order by a column that is not grouped and get 400
+	for _, query := range []string{".aggregate=sum(id)", ".aggregate=lower(name)", ".group_by=name&.order_by=id", ".group_by=name&.cursor="} {
+		resp, err = http.Get(this.baseURL + "test_db/test_table/?" + query)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// list records as CSV and NDJSON
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?.order_by=name&.page_size=2&.format=csv")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Equal("text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	this.Assert().Equal("name\nAlpha\nBeta\n", string(body))
+
+	// the columns of CSV follow the order of the query, buffered or streamed
+	for _, query := range []string{"", "&.stream=1"} {
+		resp, err = http.Get(this.baseURL + "test_db/order_lines/?.select=product,order_id&.order_by=product&.page_size=1&.format=csv" + query)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		body, err = io.ReadAll(resp.Body)
+		this.Nil(err)
+		this.Assert().Equal("product,order_id\nApple,1\n", string(body))
+	}
+
+	req, err = http.NewRequest("GET", this.baseURL+"test_db/test_table/?.order_by=name&.page_size=2&.show_total=1", nil)
+	this.Nil(err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	this.Assert().Equal(`{"name":"Alpha"}`+"\n"+`{"name":"Beta"}`+"\n", string(body))
+
+	// run a script as a workbook
+	resp, err = http.Get(this.baseURL + "test_db/list_tables/?.format=xlsx")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	workbook, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	this.Nil(err)
+	this.Assert().Contains(readZipFile(workbook, "xl/workbook.xml"), `<sheet name="list_tables"`)
+	this.Assert().Contains(readZipFile(workbook, "xl/worksheets/sheet1.xml"), `<t xml:space="preserve">TEST_GOSQLAPI</t>`)
+
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?.format=pdf")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// stream a list beyond the page size, and a script as NDJSON
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?.order_by=name&.stream=1")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyStream []map[string]any
+	err = json.Unmarshal(body, &respBodyStream)
+	this.Nil(err)
+	this.Assert().Equal("Alpha", respBodyStream[0]["name"])
+
+	// streamed rows have the same values as buffered rows
+	var respBodyBuffered []map[string]any
+	for _, query := range []string{".stream=1", ".page_size=100"} {
+		resp, err = http.Get(this.baseURL + "test_db/order_lines/?.order_by=order_id,line_no&" + query)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		body, err = io.ReadAll(resp.Body)
+		this.Nil(err)
+		respBodyStream, respBodyBuffered = respBodyBuffered, nil
+		err = json.Unmarshal(body, &respBodyBuffered)
+		this.Nil(err)
+	}
+	this.Assert().NotEmpty(respBodyBuffered)
+	this.Assert().Equal(respBodyBuffered, respBodyStream)
+
+	resp, err = http.Get(this.baseURL + "test_db/list_tables/?.stream=1&.format=ndjson")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	this.Assert().True(strings.HasPrefix(string(body), `{"name":"TEST_GOSQLAPI"}`+"\n"))
+
+	// stream with a cursor or as a workbook and get 400
+	for _, query := range []string{".stream=1&.cursor=", ".stream=1&.format=xlsx"} {
+		resp, err = http.Get(this.baseURL + "test_db/test_table/?" + query)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// import CSV, and get a report of the rows that failed
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/order_lines/?.batch_size=2", strings.NewReader("ORDER_ID,LINE_NO,PRODUCT\n2,1,Cherry\n2,1,Duplicate\n2,2,\"Date, dried\"\n2,3\n"))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "text/csv")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyImport map[string]any
+	err = json.Unmarshal(body, &respBodyImport)
+	this.Nil(err)
+	this.Assert().Equal(4, int(respBodyImport["rows"].(float64)))
+	this.Assert().Equal(2, int(respBodyImport["rows_affected"].(float64)))
+	importErrors := respBodyImport["errors"].([]any)
+	this.Assert().Equal(2, len(importErrors))
+	this.Assert().Equal(3, int(importErrors[0].(map[string]any)["line"].(float64)))
+	this.Assert().Equal(5, int(importErrors[1].(map[string]any)["line"].(float64)))
+
+	// dry run an NDJSON import, which leaves no rows
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/order_lines/?.dry_run=1", strings.NewReader(`{"order_id": 3, "line_no": 1, "product": "Elderberry"}`+"\nnot json\n"))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyDryRun map[string]any
+	err = json.Unmarshal(body, &respBodyDryRun)
+	this.Nil(err)
+	this.Assert().Equal(1, int(respBodyDryRun["rows_affected"].(float64)))
+	this.Assert().Equal(2, int(respBodyDryRun["errors"].([]any)[0].(map[string]any)["line"].(float64)))
+	this.Assert().Equal(true, respBodyDryRun["dry_run"])
+	resp, err = http.Get(this.baseURL + "test_db/order_lines/3,1")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode)
+
+	// an import that times out reports the timeout
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/order_lines/?.timeout=0.000000001", strings.NewReader(`{"order_id": 3, "line_no": 1, "product": "Elderberry"}`+"\n"))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusGatewayTimeout, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	this.Assert().Contains(string(body), "timeout of 1ns")
+	this.Assert().Contains(string(body), `"rows_affected":0`)
+
+	// import a column that is not in the table and get 400
+	req, err = http.NewRequest("POST", this.baseURL+"test_db/order_lines/", strings.NewReader("ORDER_ID,PRICE\n2,1\n"))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "text/csv")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+
+	req, err = http.NewRequest("DELETE", this.baseURL+"test_db/order_lines/", bytes.NewBuffer([]byte(`[[2, 1], [2, 2]]`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+
+	// filter on a column that does not exist and get 400
+	resp, err = http.Get(this.baseURL + "test_db/test_table/?nosuch.gt=1")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+
 	// get without auth token and get 401
 	resp, err = http.Get(this.baseURL + "test_db/token_table/")
 	this.Nil(err)
@@ -266,6 +844,77 @@ func (this *APITestSuite) testAPI(usePatch bool) {
 	defer resp.Body.Close()
 	this.Assert().Equal(http.StatusOK, resp.StatusCode)
 
+	// get with row filters
+	req, err = http.NewRequest("GET", this.baseURL+"test_db/token_table/?.show_total=1", nil)
+	this.Nil(err)
+	req.Header.Set("authorization", "row_filter")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	this.Nil(err)
+	var respBodyRowFilter map[string]any
+	err = json.Unmarshal(body, &respBodyRowFilter)
+	this.Nil(err)
+	this.Assert().Equal(1, int(respBodyRowFilter["total"].(float64)))
+	this.Assert().Equal(5, int(respBodyRowFilter["data"].([]any)[0].(map[string]any)["id"].(float64)))
+	// get a record outside of the row filters and get 404
+	req, err = http.NewRequest("GET", this.baseURL+"test_db/token_table/1", nil)
+	this.Nil(err)
+	req.Header.Set("authorization", "row_filter")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode)
+	// update a record outside of the row filters and get 404
+	req, err = http.NewRequest("PUT", this.baseURL+"test_db/token_table/1", bytes.NewBuffer([]byte(`{"exec_private": 1}`)))
+	this.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("authorization", "row_filter")
+	resp, err = client.Do(req)
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode)
+
+	// column permissions
+	if len(this.app.Tables["token_table"].ReadableColumns) > 0 {
+		req, err = http.NewRequest("GET", this.baseURL+"test_db/token_table/5", nil)
+		this.Nil(err)
+		req.Header.Set("authorization", "super")
+		resp, err = client.Do(req)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		body, err = io.ReadAll(resp.Body)
+		this.Nil(err)
+		var respBodyReadable map[string]any
+		err = json.Unmarshal(body, &respBodyReadable)
+		this.Nil(err)
+		this.Assert().Equal(4, len(respBodyReadable))
+		this.Assert().Equal("row_filter", respBodyReadable["token"])
+		this.Assert().NotContains(respBodyReadable, "row_filters")
+
+		// filter on a column that is not readable and get 400
+		req, err = http.NewRequest("GET", this.baseURL+"test_db/token_table/?exec_private=1", nil)
+		this.Nil(err)
+		req.Header.Set("authorization", "super")
+		resp, err = client.Do(req)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+
+		// write to a column that is not writable and get 400
+		req, err = http.NewRequest("PUT", this.baseURL+"test_db/token_table/5", bytes.NewBuffer([]byte(`{"token": "stolen"}`)))
+		this.Nil(err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("authorization", "super")
+		resp, err = client.Do(req)
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
 	// query metadata
 	req, err = http.NewRequest(scriptMethod, this.baseURL+"test_db/metadata/", nil)
 	req.Header.Set("Origin", "https://*.example.com")
@@ -306,6 +955,430 @@ func (this *APITestSuite) testAPI(usePatch bool) {
 	this.Assert().Equal("TEST_GOSQLAPI", strings.ToUpper(respBody8[0].(map[string]any)["name"].(string)))
 	this.Assert().Equal("TEST_GOSQLAPI_TOKENS", strings.ToUpper(respBody8[1].(map[string]any)["name"].(string)))
 
+	// openapi
+	if this.app.Web.OpenAPI {
+		resp, err = http.Get(this.baseURL + ".openapi.json")
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		body, err = io.ReadAll(resp.Body)
+		this.Nil(err)
+		var respBody9 map[string]any
+		err = json.Unmarshal(body, &respBody9)
+		this.Nil(err)
+		paths := respBody9["paths"].(map[string]any)
+		this.Assert().Contains(paths, "/test_db/test_table")
+		this.Assert().Contains(paths, "/test_db/test_table/{key}")
+		this.Assert().Contains(paths, "/test_db/init")
+		record := paths["/test_db/test_table/{key}"].(map[string]any)["get"].(map[string]any)["responses"].(map[string]any)["200"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+		this.Assert().Equal("integer", record["properties"].(map[string]any)["id"].(map[string]any)["type"])
+		params := []string{}
+		for _, param := range paths["/test_db/init"].(map[string]any)["get"].(map[string]any)["parameters"].([]any) {
+			params = append(params, param.(map[string]any)["name"].(string))
+		}
+		this.Assert().Equal([]string{"low", "high", ".format", ".stream", ".timeout"}, params)
+		this.Assert().Empty(paths["/test_db/init"].(map[string]any)["patch"].(map[string]any)["security"])
+		this.Assert().NotEmpty(paths["/test_db/token_table"].(map[string]any)["get"].(map[string]any)["security"])
+	}
+
+	// timeout
+	if this.app.Scripts["count_to"] != nil {
+		resp, err = http.Get(this.baseURL + "test_db/count_to?n=10&.timeout=5")
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		resp, err = http.Get(this.baseURL + "test_db/count_to?n=1000000000&.timeout=0.05")
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusGatewayTimeout, resp.StatusCode)
+		body, err = io.ReadAll(resp.Body)
+		this.Nil(err)
+		this.Assert().Contains(string(body), "timeout of 50ms")
+		resp, err = http.Get(this.baseURL + "test_db/count_to?n=10&.timeout=abc")
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+	resp, err = http.Get(this.baseURL + "test_db/test_table?.timeout=5")
+	this.Nil(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+
+	// metrics
+	if this.app.Web.Metrics {
+		resp, err = http.Get(this.baseURL + ".metrics")
+		this.Nil(err)
+		defer resp.Body.Close()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		this.Assert().True(strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+		body, err = io.ReadAll(resp.Body)
+		this.Nil(err)
+		metrics := string(body)
+		this.Assert().Contains(metrics, `gosqlapi_requests_total{db="test_db",object="test_table",method="GET",status="200"}`)
+		this.Assert().Contains(metrics, `gosqlapi_request_duration_seconds_bucket{db="test_db",object="token_table",method="GET",status="401",le="+Inf"}`)
+		this.Assert().Contains(metrics, `gosqlapi_auth_failures_total{reason="token_not_found"}`)
+		this.Assert().Contains(metrics, `gosqlapi_auth_failures_total{reason="not_allowed"}`)
+		this.Assert().Contains(metrics, `gosqlapi_db_open_connections{db="test_db"}`)
+	}
+
 	count--
 	fmt.Println("-------------------------------------------------------------", count)
 }
+
+func readZipFile(z *zip.Reader, name string) string {
+	f, err := z.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b, _ := io.ReadAll(f)
+	return string(b)
+}
+
+func TestReload(t *testing.T) {
+	conf := `{
+		"databases": {
+			"db1": {"type": "sqlite", "url": ":memory:"},
+			"db2": {"type": "sqlite", "url": ":memory:"}
+		},
+		"tables": {"t1": {"database": "db1", "name": "T1"}}
+	}`
+	app, err := NewApp([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db1, err := app.GetDatabase("db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := app.GetDatabase("db2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bad configurations are rejected and the current app keeps serving
+	for _, bad := range []string{
+		`{"databases": `,
+		`{"databases": {"db1": {"type": "sqlite", "url": ":memory:"}}, "tables": {"t1": {"database": "db3", "name": "T1"}}}`,
+		`{"databases": {"db1": {"type": "sqlite", "url": ":memory:"}}, "tables": {"t1": {"database": "db1", "name": "T1", "relations": {"r": {"table": "t2", "foreign_key": "T1_ID"}}}}}`,
+		`{"web": {"access_log": "xml"}, "databases": {"db1": {"type": "sqlite", "url": ":memory:"}}}`,
+		`{"databases": {"db1": {"type": "sqlite", "url": ":memory:"}}, "tables": {"t1": {"database": "db1", "name": "T1", "order_by": "LOWER(NAME)"}}}`,
+		`{"databases": {"db1": {"type": "sqlite", "url": ":memory:"}}, "tables": {"t1": {"database": "db1", "name": "T1", "exported_columns": ["NAME"], "order_by": "ID"}}}`,
+		`{"databases": {"db1": {"type": "sqlite", "url": ":memory:"}}, "tokens": {"t": [{"target_database": "db1", "row_filters": {"1=1 OR ID": "1"}}]}}`,
+		`{"slow_query": {"threshold": 100, "database": "db2", "table": "SLOW_QUERIES"}, "databases": {"db1": {"type": "sqlite", "url": ":memory:"}}}`,
+	} {
+		if err := app.reload([]byte(bad)); err == nil {
+			t.Errorf("reload accepted bad configuration %s", bad)
+		}
+		if app.current() != app {
+			t.Errorf("app swapped on bad configuration %s", bad)
+		}
+	}
+
+	conf = `{
+		"databases": {
+			"db1": {"type": "sqlite", "url": ":memory:"}
+		},
+		"tables": {"t2": {"database": "db1", "name": "T2"}}
+	}`
+	// a request running on the app keeps its databases open
+	running := app.acquire()
+	err = app.reload([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := app.current()
+	if next == app {
+		t.Fatal("app not swapped")
+	}
+	if app.acquire() != next {
+		t.Error("request started on the replaced app")
+	}
+	next.release()
+	if next.Tables["t2"] == nil || next.Tables["t1"] != nil {
+		t.Error("tables not reloaded")
+	}
+	if len(next.cursorKey) != 32 || !bytes.Equal(next.cursorKey, app.cursorKey) {
+		t.Error("cursor key not kept across the reload")
+	}
+	if next.Databases["db1"].conn != db1.conn {
+		t.Error("connection pool of db1 not reused")
+	}
+	if err := db1.conn.Ping(); err != nil {
+		t.Errorf("connection pool of db1 closed, %v", err)
+	}
+	if err := db2.conn.Ping(); err != nil {
+		t.Errorf("connection pool of db2 closed under a running request, %v", err)
+	}
+	running.release()
+	for range 100 {
+		if db2.conn.Ping() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := db2.conn.Ping(); err == nil {
+		t.Error("connection pool of db2 not closed")
+	}
+	app.shutdown()
+}
+
+func TestFilterColumns(t *testing.T) {
+	conf := `{
+		"databases": {
+			"db": {"type": "sqlite", "url": ":memory:", "init_sql": [
+				"CREATE TABLE T (ID INTEGER PRIMARY KEY, NAME TEXT)",
+				"INSERT INTO T VALUES (1, 'Alpha'), (2, 'Beta')"
+			]}
+		},
+		"tables": {"t": {"database": "db", "name": "T", "exported_columns": ["NAME"], "public_read": true}}
+	}`
+	app, err := NewApp([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.shutdown()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{db}/{obj}", app.serve((*App).defaultHandler))
+	for url, want := range map[string]int{
+		"/db/t?name.eq=Beta": http.StatusOK,
+		"/db/t?id.gt=1":      http.StatusBadRequest, // not exported
+		"/db/t?nosuch.gt=1":  http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != want || (want == http.StatusOK && w.Body.String() != `[{"name":"Beta"}]`+"\n") {
+			t.Errorf("GET %s = %d, %s, want %d", url, w.Code, w.Body, want)
+		}
+	}
+}
+
+func TestImportDeadline(t *testing.T) {
+	conf := `{
+		"databases": {
+			"db": {"type": "sqlite", "url": ":memory:", "max_open_conns": 1, "init_sql": ["CREATE TABLE T (ID INTEGER PRIMARY KEY, NAME TEXT)"]}
+		},
+		"tables": {"t": {"database": "db", "name": "T", "public_read": true, "public_write": true}}
+	}`
+	app, err := NewApp([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.shutdown()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{db}/{obj}", app.serve((*App).defaultHandler))
+	server := httptest.NewUnstartedServer(mux)
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// the body takes longer to send than the timeouts of the server, but each
+	// batch arrives in time
+	body, writer := io.Pipe()
+	go func() {
+		for i := range 5 {
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprintf(writer, `{"id": %d, "name": "row %d"}`+"\n", i+1, i+1)
+		}
+		writer.Close()
+	}()
+	resp, err := http.Post(server.URL+"/db/t?.batch_size=1", "application/x-ndjson", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `"rows_affected":5`) {
+		t.Errorf("import = %d, %s", resp.StatusCode, b)
+	}
+}
+
+func TestDatabasePool(t *testing.T) {
+	conf := `{
+		"databases": {
+			"db1": {
+				"type": "sqlite",
+				"url": ":memory:",
+				"max_open_conns": 3,
+				"max_idle_conns": 1,
+				"conn_max_lifetime": 60,
+				"ping": true,
+				"init_sql": ["PRAGMA foreign_keys = ON", "CREATE TABLE T1 (ID INTEGER PRIMARY KEY)"]
+			}
+		}
+	}`
+	app, err := NewApp([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db1 := app.Databases["db1"]
+	if db1.conn == nil {
+		t.Fatal("database not connected by the ping")
+	}
+	if stats := db1.conn.Stats(); stats.MaxOpenConnections != 3 {
+		t.Errorf("max open connections = %d, want 3", stats.MaxOpenConnections)
+	}
+
+	// every connection of an in-memory database is a new database, so the
+	// init SQL must have run on each of them
+	conns := []*sql.Conn{}
+	for range 3 {
+		conn, err := db1.conn.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		var foreignKeys, rows int
+		if err := conn.QueryRowContext(context.Background(), "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.QueryRowContext(context.Background(), "SELECT COUNT(*) FROM T1").Scan(&rows); err != nil {
+			t.Error(err)
+		}
+		if foreignKeys != 1 {
+			t.Errorf("foreign_keys = %d, want 1", foreignKeys)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	// pool settings are applied to the reused pool, changes to the init SQL
+	// open a new one
+	err = app.reload([]byte(strings.Replace(conf, `"max_open_conns": 3`, `"max_open_conns": 5`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := app.current().Databases["db1"]
+	if next.conn != db1.conn {
+		t.Error("connection pool of db1 not reused")
+	}
+	if stats := next.conn.Stats(); stats.MaxOpenConnections != 5 {
+		t.Errorf("max open connections = %d, want 5", stats.MaxOpenConnections)
+	}
+	// a rejected reload leaves the pool settings of the live app
+	rejected := strings.Replace(conf, `"max_open_conns": 3`, `"max_open_conns": 7`, 1)
+	rejected = strings.Replace(rejected, `"databases": {`, `"databases": {"db2": {"type": "sqlite", "url": "/nonexistent/db2.sqlite3", "ping": true},`, 1)
+	if err := app.reload([]byte(rejected)); err == nil {
+		t.Fatal("reload with an unreachable database passed")
+	}
+	if stats := next.conn.Stats(); stats.MaxOpenConnections != 5 {
+		t.Errorf("max open connections after a rejected reload = %d, want 5", stats.MaxOpenConnections)
+	}
+	err = app.reload([]byte(strings.Replace(conf, `"PRAGMA foreign_keys = ON", `, "", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.current().Databases["db1"].conn == db1.conn {
+		t.Error("connection pool of db1 reused with different init SQL")
+	}
+
+	// unreachable databases and failing init SQL are rejected by the ping
+	for _, bad := range []string{
+		`{"databases": {"db1": {"type": "sqlite", "url": "/nonexistent/db1.sqlite3", "ping": true}}}`,
+		`{"databases": {"db1": {"type": "sqlite", "url": ":memory:", "ping": true, "init_sql": ["SELEKT 1"]}}}`,
+	} {
+		if _, err := NewApp([]byte(bad)); err == nil {
+			t.Errorf("ping passed for %s", bad)
+		}
+	}
+	app.shutdown()
+}
+
+func TestReplicas(t *testing.T) {
+	dir := t.TempDir()
+	urls := map[string]string{}
+	for _, name := range []string{"primary", "replica1", "replica2"} {
+		urls[name] = filepath.Join(dir, name+".db")
+		db, err := sql.Open("sqlite", urls[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(fmt.Sprintf(`CREATE TABLE T (ID INTEGER PRIMARY KEY, SRC TEXT); INSERT INTO T VALUES (1, '%s')`, name))
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := fmt.Sprintf(`{
+		"web": {"metrics": true},
+		"databases": {
+			"db": {"type": "sqlite", "url": %q, "replicas": [%q, %q], "ping": true}
+		},
+		"tables": {"t": {"database": "db", "name": "T", "public_read": true, "public_write": true}},
+		"scripts": {
+			"read": {"database": "db", "sql": "SELECT SRC FROM T", "public_exec": true},
+			"mixed": {"database": "db", "sql": "update T SET SRC = SRC; SELECT SRC FROM T", "public_exec": true}
+		}
+	}`, urls["primary"], urls["replica1"], urls["replica2"])
+	app, err := NewApp([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.shutdown()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.metrics", app.serve((*App).metricsHandler))
+	mux.HandleFunc("/{db}/{obj}", app.serve((*App).defaultHandler))
+	mux.HandleFunc("/{db}/{obj}/{key}", app.serve((*App).defaultHandler))
+	source := func(method string, url string) string {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s = %d, %s", method, url, w.Code, w.Body)
+		}
+		for _, name := range []string{"primary", "replica1", "replica2"} {
+			if strings.Contains(w.Body.String(), name) {
+				return name
+			}
+		}
+		return w.Body.String()
+	}
+
+	// reads are balanced across the replicas
+	sources := []string{source("GET", "/db/t/1"), source("GET", "/db/t/1"), source("GET", "/db/read")}
+	if !reflect.DeepEqual(sources, []string{"replica1", "replica2", "replica1"}) {
+		t.Errorf("reads served by %v", sources)
+	}
+	for _, url := range []string{"/db/t/1?.primary=true", "/db/read?.primary=true", "/db/mixed"} {
+		if got := source("GET", url); got != "primary" {
+			t.Errorf("GET %s served by %s", url, got)
+		}
+	}
+
+	// unhealthy replicas are ejected, and reads fall back to the primary
+	// when none is left
+	db := app.Databases["db"]
+	db.replicas.replicas[0].conn.Close()
+	db.replicas.check()
+	for range 2 {
+		if got := source("GET", "/db/t/1"); got != "replica2" {
+			t.Errorf("read served by %s with replica1 ejected", got)
+		}
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/.metrics", nil))
+	if !strings.Contains(w.Body.String(), `gosqlapi_db_replica_healthy{db="db",replica="0"} 0`) ||
+		!strings.Contains(w.Body.String(), `gosqlapi_db_replica_healthy{db="db",replica="1"} 1`) {
+		t.Errorf("metrics = %s", w.Body)
+	}
+	db.replicas.replicas[1].conn.Close()
+	db.replicas.check()
+	if got := source("GET", "/db/t/1"); got != "primary" {
+		t.Errorf("read served by %s with all replicas ejected", got)
+	}
+
+	// the replicas are part of the connection pool reused on reload
+	err = app.reload([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.current().Databases["db"].replicas != db.replicas {
+		t.Error("replicas of db not reused")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+const maxBatchRows = 100
+const maxBatchParams = 999
+
+// RowError is an error caused by a row of a bulk operation.
+type RowError struct {
+	Index int
+	Err   error
+}
+
+func (this *RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", this.Index, this.Err)
+}
+
+func (this *RowError) Unwrap() error {
+	return this.Err
+}
+
+// runTableBulk inserts, updates or deletes all rows in one transaction.
+func runTableBulk(ctx context.Context, method string, database *Database, table *Table, params map[string]any, rows []any, access *Access, rowFilters map[string]any) (any, error) {
+	if len(rows) == 0 {
+		return nil, badRequest("no rows found in request body")
+	}
+	db, err := database.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string]any
+	switch method {
+	case http.MethodPost:
+		result, err = insertRows(ctx, tx, database, table, rows, paramBool(params[".upsert"], table.Upsert), access, rowFilters)
+	case http.MethodPut:
+		result, err = updateRows(ctx, tx, database, table, params, rows, access, rowFilters)
+	case http.MethodDelete:
+		result, err = deleteRows(ctx, tx, database, table, rows, rowFilters)
+	default:
+		err = badRequest("method %s does not accept an array", method)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if paramBool(params[".returning"], false) {
+		keys, _ := result["keys"].([]any)
+		result["rows"], err = selectRows(ctx, tx, database, table, keys, access, rowFilters)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// rowKey returns the primary key of row, which can be the key itself, an array
+// of the values of a composite key, or an object that contains the key.
+func rowKey(table *Table, row any) ([]any, map[string]any, error) {
+	switch v := row.(type) {
+	case nil:
+		return nil, nil, badRequest("key must not be null")
+	case []any:
+		if len(v) != len(table.PrimaryKey) {
+			return nil, nil, badRequest("key must have %d values for primary key %s", len(table.PrimaryKey), table.PrimaryKey)
+		}
+		return v, nil, nil
+	case map[string]any:
+		key, ok := table.KeyFromMap(v)
+		if !ok {
+			return nil, nil, badRequest("primary key %s not found", table.PrimaryKey)
+		}
+		fields := map[string]any{}
+		for k, value := range v {
+			if !columnAllowed(table.PrimaryKey, k) {
+				fields[k] = value
+			}
+		}
+		return key, fields, nil
+	}
+	if len(table.PrimaryKey) != 1 {
+		return nil, nil, badRequest("key must have %d values for primary key %s", len(table.PrimaryKey), table.PrimaryKey)
+	}
+	return []any{row}, nil, nil
+}
+
+func updateRows(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, params map[string]any, rows []any, access *Access, rowFilters map[string]any) (map[string]any, error) {
+	var rowsAffected int64
+	keys := []any{}
+	for index, row := range rows {
+		key, fields, err := rowKey(table, row)
+		if err != nil {
+			return nil, &RowError{Index: index, Err: err}
+		}
+		if fields == nil {
+			// a key alone updates the row with the query parameters
+			fields = map[string]any{}
+			for k, v := range params {
+				if !strings.HasPrefix(k, ".") {
+					fields[k] = v
+				}
+			}
+		}
+		if len(fields) == 0 {
+			return nil, &RowError{Index: index, Err: badRequest("no columns to update")}
+		}
+		result, err := updateRow(ctx, conn, database, table, key, fields, access, rowFilters)
+		if err != nil {
+			return nil, &RowError{Index: index, Err: err}
+		}
+		rowsAffected += result["rows_affected"]
+		key, _ = writtenKey(table, key, fields, result)
+		if key == nil {
+			keys = append(keys, nil)
+		} else {
+			keys = append(keys, keyValue(key))
+		}
+	}
+	return map[string]any{
+		"rows_affected": rowsAffected,
+		"keys":          keys,
+	}, nil
+}
+
+func deleteRows(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, rows []any, rowFilters map[string]any) (map[string]any, error) {
+	var rowsAffected int64
+	for index, row := range rows {
+		key, _, err := rowKey(table, row)
+		if err != nil {
+			return nil, &RowError{Index: index, Err: err}
+		}
+		result, err := deleteRow(ctx, conn, database, table, key, rowFilters)
+		if err != nil {
+			return nil, &RowError{Index: index, Err: err}
+		}
+		rowsAffected += result["rows_affected"]
+	}
+	return map[string]any{"rows_affected": rowsAffected}, nil
+}
+
+// insertRows inserts rows with multi-row INSERT statements where the dialect
+// allows it. Consecutive rows with the same columns are inserted in one
+// statement. The keys of the inserted rows are taken from the rows, or from the
+// database when they are generated. With upsert, existing rows are updated.
+func insertRows(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, rows []any, upsert bool, access *Access, rowFilters map[string]any) (map[string]any, error) {
+	writableColumns := table.GetWritableColumns(access)
+	objects := []map[string]any{}
+	for index, row := range rows {
+		object, ok := row.(map[string]any)
+		if !ok || len(object) == 0 {
+			return nil, &RowError{Index: index, Err: badRequest("row must be a non-empty object")}
+		}
+		err := checkColumns(object, writableColumns, "writable")
+		if err != nil {
+			return nil, &RowError{Index: index, Err: err}
+		}
+		for k := range object {
+			if !reColumnName.MatchString(k) {
+				return nil, &RowError{Index: index, Err: badRequest("invalid column %s", k)}
+			}
+		}
+		forceRowFilters(object, rowFilters)
+		objects = append(objects, object)
+	}
+
+	var rowsAffected int64
+	keys := make([]any, len(objects))
+	for start := 0; start < len(objects); {
+		columns := sortedKeys(objects[start])
+		_, hasKey := table.KeyFromMap(objects[start])
+		end := start + 1
+		if database.supportsMultiRowInsert() && (hasKey || upsert || database.supportsInsertReturning()) {
+			batchRows := min(maxBatchRows, max(1, maxBatchParams/len(columns)))
+			for end < len(objects) && end-start < batchRows && slices.Equal(sortedKeys(objects[end]), columns) {
+				end++
+			}
+		}
+
+		savepoint, rollback, release := "", "", ""
+		if end-start > 1 {
+			savepoint, rollback, release = database.savepointStatements("bulk_insert")
+			if _, err := withContext(ctx, conn).Exec(savepoint); err != nil {
+				return nil, err
+			}
+		}
+		n, batchKeys, err := insertBatch(ctx, conn, database, table, columns, objects[start:end], upsert, rowFilters)
+		if err != nil && savepoint != "" {
+			// insert the rows one by one, which either succeeds where the
+			// multi-row statement failed or finds the row that failed
+			if _, rollbackErr := withContext(ctx, conn).Exec(rollback); rollbackErr != nil {
+				return nil, err
+			}
+			n, batchKeys, err = 0, make([]any, end-start), nil
+			for index := start; index < end; index++ {
+				rowN, rowKeys, rowErr := insertBatch(ctx, conn, database, table, columns, objects[index:index+1], upsert, rowFilters)
+				if rowErr != nil {
+					return nil, &RowError{Index: index, Err: rowErr}
+				}
+				n += rowN
+				batchKeys[index-start] = rowKeys[0]
+			}
+		}
+		if err != nil {
+			return nil, &RowError{Index: start, Err: err}
+		}
+		if release != "" {
+			if _, err := withContext(ctx, conn).Exec(release); err != nil {
+				return nil, err
+			}
+		}
+		rowsAffected += n
+		copy(keys[start:end], batchKeys)
+		start = end
+	}
+	return map[string]any{
+		"rows_affected": rowsAffected,
+		"keys":          keys,
+	}, nil
+}
+
+func insertBatch(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, columns []string, objects []map[string]any, upsert bool, rowFilters map[string]any) (int64, []any, error) {
+	values := []any{}
+	rowPlaceholders := []string{}
+	for _, object := range objects {
+		placeholders := []string{}
+		for _, column := range columns {
+			placeholders = append(placeholders, gosqlcrud.GetPlaceHolder(len(values), database.dbType))
+			values = append(values, object[column])
+		}
+		rowPlaceholders = append(rowPlaceholders, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+	}
+
+	keys := make([]any, len(objects))
+	generated := false
+	for index, object := range objects {
+		if key, ok := table.KeyFromMap(object); ok {
+			keys[index] = keyValue(key)
+		} else {
+			generated = true
+		}
+	}
+
+	if upsert {
+		q, err := database.upsertStatement(table, columns, len(objects), rowFilters)
+		if err != nil {
+			return 0, nil, err
+		}
+		result, err := database.exec(ctx, conn, table.Name+" upsert", nil, q, values...)
+		if err != nil {
+			return 0, nil, err
+		}
+		return result["rows_affected"], keys, nil
+	}
+
+	columnList := strings.Join(columns, ", ")
+	valueList := strings.Join(rowPlaceholders, ", ")
+	if generated && database.supportsInsertReturning() {
+		q := fmt.Sprintf(`INSERT INTO %s (%s) VALUES %s RETURNING %s`, table.Name, columnList, valueList, strings.Join(table.PrimaryKey, ", "))
+		returned, err := database.queryToMaps(ctx, conn, table.Name+" insert", nil, q, values...)
+		if err != nil {
+			return 0, nil, err
+		}
+		for index, row := range returned {
+			if key, ok := table.KeyFromMap(row); ok && index < len(keys) {
+				keys[index] = keyValue(key)
+			}
+		}
+		return int64(len(returned)), keys, nil
+	}
+
+	if generated && database.dbType == gosqlcrud.SQLServer && len(objects) == 1 && len(table.PrimaryKey) == 1 {
+		// the driver has no last insert id, and OUTPUT fails on tables with
+		// triggers
+		q := fmt.Sprintf(`INSERT INTO %s (%s) VALUES %s; SELECT CAST(SCOPE_IDENTITY() AS BIGINT) AS %s`, table.Name, columnList, valueList, table.PrimaryKey[0])
+		returned, err := database.queryToMaps(ctx, conn, table.Name+" insert", nil, q, values...)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(returned) == 1 {
+			if key, ok := table.KeyFromMap(returned[0]); ok && key[0] != nil {
+				keys[0] = keyValue(key)
+			}
+		}
+		return 1, keys, nil
+	}
+
+	result, err := database.exec(ctx, conn, table.Name+" insert", nil, fmt.Sprintf(`INSERT INTO %s (%s) VALUES %s`, table.Name, columnList, valueList), values...)
+	if err != nil {
+		return 0, nil, err
+	}
+	if generated && len(objects) == 1 && len(table.PrimaryKey) == 1 {
+		if lastInsertId, ok := result["last_insert_id"]; ok && lastInsertId != 0 {
+			keys[0] = lastInsertId
+		}
+	}
+	return result["rows_affected"], keys, nil
+}
+
+// rowValue returns the value of column in row, matching the column name case
+// insensitively.
+func rowValue(row map[string]any, column string) (any, bool) {
+	for k, v := range row {
+		if strings.EqualFold(k, column) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (this *Database) supportsMultiRowInsert() bool {
+	return this.dbType != gosqlcrud.Oracle
+}
+
+// supportsInsertReturning reports whether generated keys of multi-row inserts
+// can be returned by the INSERT statement itself. The rows of OUTPUT of SQL
+// Server are in no particular order, so that its rows with generated keys are
+// inserted one by one.
+func (this *Database) supportsInsertReturning() bool {
+	switch this.dbType {
+	case gosqlcrud.PostgreSQL, gosqlcrud.SQLite:
+		return true
+	}
+	return false
+}
+
+// savepointStatements returns the statements that create, roll back to and
+// release the savepoint name. The release statement is empty where savepoints
+// cannot be released.
+func (this *Database) savepointStatements(name string) (string, string, string) {
+	switch this.dbType {
+	case gosqlcrud.SQLServer:
+		return "SAVE TRANSACTION " + name, "ROLLBACK TRANSACTION " + name, ""
+	case gosqlcrud.Oracle:
+		return "SAVEPOINT " + name, "ROLLBACK TO SAVEPOINT " + name, ""
+	case gosqlcrud.PostgreSQL, gosqlcrud.MySQL, gosqlcrud.SQLite:
+		return "SAVEPOINT " + name, "ROLLBACK TO SAVEPOINT " + name, "RELEASE SAVEPOINT " + name
+	}
+	return "", "", ""
+}
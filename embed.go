@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+// embedding is a relation to embed in the records of a table, with the access
+// of the caller to the related table.
+type embedding struct {
+	name       string
+	relation   *Relation
+	table      *Table
+	access     *Access
+	rowFilters map[string]any
+}
+
+// embeddings resolves the relations in .embed of table, and authorizes the
+// caller to read each related table.
+func (this *App) embeddings(table *Table, embedParam string, authorization string, databaseId string, origin string, referer string, r *http.Request) ([]*embedding, error) {
+	embeds := []*embedding{}
+	for name := range strings.SplitSeq(embedParam, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		relation := table.Relations[name]
+		if relation == nil {
+			return nil, badRequest("relation %s not found", name)
+		}
+		access, err := this.authorize(r.Context(), http.MethodGet, authorization, databaseId, relation.Table, origin, referer)
+		if err != nil {
+			return nil, &StatusError{StatusCode: http.StatusUnauthorized, Err: err}
+		}
+		rowFilters, err := access.RowFilterValues(r)
+		if err != nil {
+			return nil, &StatusError{StatusCode: http.StatusUnauthorized, Err: err}
+		}
+		embeds = append(embeds, &embedding{
+			name:       name,
+			relation:   relation,
+			table:      this.Tables[relation.Table],
+			access:     access,
+			rowFilters: rowFilters,
+		})
+	}
+	return embeds, nil
+}
+
+// embedRows sets the related records of each embedding in rows of table. The
+// related records are selected in batches by the primary keys of rows, which
+// must be in rows.
+func embedRows(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, rows []map[string]any, embeds []*embedding) error {
+	if len(rows) == 0 || len(embeds) == 0 {
+		return nil
+	}
+	rowKeys := make([]string, len(rows))
+	keys := [][]any{}
+	seen := map[string]bool{}
+	for i, row := range rows {
+		key := []any{}
+		for _, column := range table.PrimaryKey {
+			value, ok := rowValue(row, column)
+			if !ok {
+				return badRequest("primary key %s must be selected to embed relations", table.PrimaryKey)
+			}
+			key = append(key, value)
+		}
+		rowKeys[i] = keyString(key)
+		if !seen[rowKeys[i]] {
+			seen[rowKeys[i]] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, embed := range embeds {
+		columns, err := embed.table.ListColumns(embed.table.GetReadableColumns(embed.access))
+		if err != nil {
+			return err
+		}
+		for _, column := range embed.relation.ForeignKey {
+			if !columnAllowed(columns, column) {
+				return badRequest("foreign key %s of relation %s must be readable", embed.relation.ForeignKey, embed.name)
+			}
+		}
+		columnList := "*"
+		if len(columns) > 0 {
+			columnList = strings.Join(columns, ", ")
+		}
+		gosqlcrud.SqlSafe(&columnList)
+		order := []*orderColumn{}
+		for _, column := range embed.table.PrimaryKey {
+			order = append(order, &orderColumn{Column: column})
+		}
+
+		children := map[string][]map[string]any{}
+		batchSize := max(1, maxBatchParams/len(embed.relation.ForeignKey))
+		for batch := range slices.Chunk(keys, batchSize) {
+			where, values := database.foreignKeyWhere(embed.relation.ForeignKey, batch)
+			rowWhere, rowValues, err := database.rowFilterWhere(embed.rowFilters, len(values))
+			if err != nil {
+				return err
+			}
+			q := fmt.Sprintf(`SELECT %s FROM %s WHERE %s %s %s`, columnList, embed.table.Name, where, rowWhere, database.orderByClause(order))
+			data, err := database.queryToMaps(ctx, conn, embed.table.Name+" embed", nil, q, append(values, rowValues...)...)
+			if err != nil {
+				return err
+			}
+			for _, child := range data {
+				key := []any{}
+				for _, column := range embed.relation.ForeignKey {
+					value, _ := rowValue(child, column)
+					key = append(key, value)
+				}
+				childKey := keyString(key)
+				children[childKey] = append(children[childKey], child)
+			}
+		}
+		for i, row := range rows {
+			if related := children[rowKeys[i]]; related != nil {
+				row[embed.name] = related
+			} else {
+				row[embed.name] = []map[string]any{}
+			}
+		}
+	}
+	return nil
+}
+
+// foreignKeyWhere returns the condition that matches the foreign key columns to
+// any of keys, and its values.
+func (this *Database) foreignKeyWhere(foreignKey Columns, keys [][]any) (string, []any) {
+	values := []any{}
+	if len(foreignKey) == 1 {
+		placeholders := []string{}
+		for _, key := range keys {
+			placeholders = append(placeholders, gosqlcrud.GetPlaceHolder(len(values), this.dbType))
+			values = append(values, key[0])
+		}
+		return fmt.Sprintf("%s IN (%s)", foreignKey[0], strings.Join(placeholders, ", ")), values
+	}
+	conditions := []string{}
+	for _, key := range keys {
+		columns := []string{}
+		for i, column := range foreignKey {
+			columns = append(columns, fmt.Sprintf("%s = %s", column, gosqlcrud.GetPlaceHolder(len(values), this.dbType)))
+			values = append(values, key[i])
+		}
+		conditions = append(conditions, "("+strings.Join(columns, " AND ")+")")
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", values
+}
+
+// keyString returns a string that identifies the values of key, to match keys
+// read from different tables.
+func keyString(key []any) string {
+	b, _ := json.Marshal(key)
+	return string(b)
+}
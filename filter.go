@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+var filterOperators = []string{"eq", "ne", "gt", "gte", "lt", "lte", "like", "ilike", "in", "nin", "is"}
+
+var reColumnName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$#]*$`)
+
+// splitFilterParams separates filters with an operator, such as `age.gt`, from
+// the other parameters.
+func splitFilterParams(params map[string]any) (map[string]any, map[string]any) {
+	equalParams := map[string]any{}
+	filterParams := map[string]any{}
+	for k, v := range params {
+		if !strings.HasPrefix(k, ".") && strings.Contains(k, ".") {
+			filterParams[k] = v
+		} else {
+			equalParams[k] = v
+		}
+	}
+	return equalParams, filterParams
+}
+
+// BuildFilterWhere builds the WHERE conditions for filters in the form of
+// `column.operator=value`. Placeholders are numbered from startIndex. Without
+// exported columns, the columns are checked against the columns in the
+// database.
+func (this *Database) BuildFilterWhere(table *Table, filterParams map[string]any, startIndex int) (string, []any, error) {
+	where := ""
+	values := []any{}
+	var tableColumns []string
+	for _, k := range sortedKeys(filterParams) {
+		sepIndex := strings.LastIndex(k, ".")
+		column, operator := k[:sepIndex], strings.ToLower(k[sepIndex+1:])
+		if !slices.Contains(filterOperators, operator) {
+			return "", nil, badRequest("unknown filter operator %s in %s", operator, k)
+		}
+		if !reColumnName.MatchString(column) || !table.IsColumnExported(column) {
+			return "", nil, badRequest("column %s is not allowed in filters", column)
+		}
+		if len(table.ExportedColumns) == 0 {
+			if tableColumns == nil {
+				var err error
+				tableColumns, err = this.TableColumns(table)
+				if err != nil {
+					return "", nil, err
+				}
+			}
+			if !columnAllowed(tableColumns, column) {
+				return "", nil, badRequest("column %s is not allowed in filters", column)
+			}
+		}
+		value := filterParams[k]
+		placeholder := func() string {
+			return gosqlcrud.GetPlaceHolder(startIndex+len(values), this.dbType)
+		}
+
+		switch operator {
+		case "is":
+			switch strings.ToLower(fmt.Sprint(value)) {
+			case "null", "<nil>":
+				where += fmt.Sprintf(" AND %s IS NULL", column)
+			case "notnull", "not_null":
+				where += fmt.Sprintf(" AND %s IS NOT NULL", column)
+			default:
+				return "", nil, badRequest("%s must be null or notnull", k)
+			}
+		case "in", "nin":
+			var items []any
+			switch v := value.(type) {
+			case []any:
+				items = v
+			case nil:
+				return "", nil, badRequest("%s must not be null", k)
+			default:
+				for _, item := range strings.Split(fmt.Sprint(v), ",") {
+					items = append(items, item)
+				}
+			}
+			if len(items) == 0 {
+				return "", nil, badRequest("%s must not be empty", k)
+			}
+			placeholders := []string{}
+			for _, item := range items {
+				placeholders = append(placeholders, placeholder())
+				values = append(values, item)
+			}
+			not := ""
+			if operator == "nin" {
+				not = "NOT "
+			}
+			where += fmt.Sprintf(" AND %s %sIN (%s)", column, not, strings.Join(placeholders, ", "))
+		case "eq", "ne":
+			if value == nil {
+				if operator == "eq" {
+					where += fmt.Sprintf(" AND %s IS NULL", column)
+				} else {
+					where += fmt.Sprintf(" AND %s IS NOT NULL", column)
+				}
+				continue
+			}
+			sqlOperator := "="
+			if operator == "ne" {
+				sqlOperator = "<>"
+			}
+			where += fmt.Sprintf(" AND %s %s %s", column, sqlOperator, placeholder())
+			values = append(values, value)
+		default:
+			if value == nil {
+				return "", nil, badRequest("%s must not be null", k)
+			}
+			switch operator {
+			case "gt":
+				where += fmt.Sprintf(" AND %s > %s", column, placeholder())
+			case "gte":
+				where += fmt.Sprintf(" AND %s >= %s", column, placeholder())
+			case "lt":
+				where += fmt.Sprintf(" AND %s < %s", column, placeholder())
+			case "lte":
+				where += fmt.Sprintf(" AND %s <= %s", column, placeholder())
+			case "like":
+				where += fmt.Sprintf(" AND %s LIKE %s", column, placeholder())
+			case "ilike":
+				if this.dbType == gosqlcrud.PostgreSQL {
+					where += fmt.Sprintf(" AND %s ILIKE %s", column, placeholder())
+				} else {
+					where += fmt.Sprintf(" AND LOWER(%s) LIKE LOWER(%s)", column, placeholder())
+				}
+			}
+			values = append(values, value)
+		}
+	}
+	return where, values, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+	formatXLSX   = "xlsx"
+)
+
+var formatContentTypes = map[string]string{
+	formatJSON:   "application/json; charset=utf-8",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatNDJSON: "application/x-ndjson; charset=utf-8",
+	formatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// acceptFormats maps the media types of the Accept header to formats.
+var acceptFormats = map[string]string{
+	"application/json":     formatJSON,
+	"text/csv":             formatCSV,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+	"application/jsonl":    formatNDJSON,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": formatXLSX,
+}
+
+// responseFormat returns the format of the response, which is .format if it is
+// set, otherwise the first supported media type of the Accept header, and JSON
+// by default.
+func responseFormat(r *http.Request, params map[string]any) (string, error) {
+	if format, ok := params[".format"]; ok {
+		f := strings.ToLower(fmt.Sprint(format))
+		if _, ok := formatContentTypes[f]; !ok {
+			return "", badRequest("unsupported format %s", f)
+		}
+		return f, nil
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for mediaRange := range strings.SplitSeq(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			if format, ok := acceptFormats[mediaType]; ok {
+				return format, nil
+			}
+		}
+	}
+	return formatJSON, nil
+}
+
+// section is a named list of records, a sheet of a workbook or a section of a
+// CSV file.
+type section struct {
+	name    string
+	rows    []map[string]any
+	columns []string
+}
+
+// resultSections splits result into sections. The results of a script have a
+// section for each exported label, and other results have a single section
+// named name, whose columns are those of the query of label. list tells
+// whether result is a list of table records.
+func resultSections(ctx context.Context, name string, label string, result any, script bool, list bool) []*section {
+	if labeled, ok := result.(map[string]any); ok && script {
+		sections := []*section{}
+		for _, label := range sortedKeys(labeled) {
+			sections = append(sections, &section{name: label, rows: resultRows(labeled[label], false), columns: queryColumns(ctx, label)})
+		}
+		return sections
+	}
+	return []*section{{name: name, rows: resultRows(result, list), columns: queryColumns(ctx, label)}}
+}
+
+type columnOrderKey struct{}
+
+// columnOrder keeps the columns of the queries of a request by label, in the
+// order of the query, which the records do not keep.
+type columnOrder struct {
+	columns map[string][]string
+	mu      sync.Mutex
+}
+
+// withColumnOrder returns ctx keeping the columns of the queries run with it.
+func withColumnOrder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, columnOrderKey{}, &columnOrder{columns: map[string][]string{}})
+}
+
+// setQueryColumns keeps the columns of the query of label, if ctx keeps them.
+func setQueryColumns(ctx context.Context, label string, columns []string) {
+	if order, ok := ctx.Value(columnOrderKey{}).(*columnOrder); ok {
+		order.mu.Lock()
+		defer order.mu.Unlock()
+		order.columns[label] = columns
+	}
+}
+
+// queryColumns returns the columns of the query of label, or nil.
+func queryColumns(ctx context.Context, label string) []string {
+	if order, ok := ctx.Value(columnOrderKey{}).(*columnOrder); ok {
+		order.mu.Lock()
+		defer order.mu.Unlock()
+		return order.columns[label]
+	}
+	return nil
+}
+
+// resultRows returns the records of result. A single record or statement result
+// is a list of one record.
+func resultRows(result any, list bool) []map[string]any {
+	switch v := result.(type) {
+	case []map[string]any:
+		return v
+	case map[string]any:
+		if data, ok := v["data"].([]map[string]any); ok && list {
+			return data
+		}
+		return []map[string]any{v}
+	case map[string]int64:
+		row := map[string]any{}
+		for k, n := range v {
+			row[k] = n
+		}
+		return []map[string]any{row}
+	case nil:
+		return []map[string]any{}
+	}
+	return []map[string]any{{"result": result}}
+}
+
+// sectionColumns returns the columns of the records in s, in the order of the
+// columns of the query. Other columns, such as embedded records, follow sorted
+// as the keys of JSON objects.
+func sectionColumns(s *section) []string {
+	columns := map[string]bool{}
+	for _, row := range s.rows {
+		for column := range row {
+			columns[column] = true
+		}
+	}
+	ordered := []string{}
+	for _, column := range s.columns {
+		if columns[column] {
+			ordered = append(ordered, column)
+			delete(columns, column)
+		}
+	}
+	return append(ordered, slices.Sorted(maps.Keys(columns))...)
+}
+
+// writeSections writes sections to w in format, which is not JSON.
+func writeSections(w http.ResponseWriter, format string, name string, sections []*section) error {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case formatCSV:
+		err = writeCSV(&buf, sections)
+	case formatNDJSON:
+		err = writeNDJSON(&buf, sections)
+	case formatXLSX:
+		err = writeXLSX(&buf, sections)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, name))
+	default:
+		err = fmt.Errorf("unsupported format %s", format)
+	}
+	if err != nil {
+		w.Header().Del("Content-Disposition")
+		return err
+	}
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// writeCSV writes each section as a header row followed by the records. When
+// there are several sections, each starts with a row of its name, and sections
+// are separated by an empty line.
+func writeCSV(w io.Writer, sections []*section) error {
+	writer := csv.NewWriter(w)
+	for i, s := range sections {
+		if len(sections) > 1 {
+			if i > 0 {
+				writer.Flush()
+				if _, err := io.WriteString(w, "\n"); err != nil {
+					return err
+				}
+			}
+			if err := writer.Write([]string{s.name}); err != nil {
+				return err
+			}
+		}
+		columns := sectionColumns(s)
+		if err := writer.Write(columns); err != nil {
+			return err
+		}
+		for _, row := range s.rows {
+			record := make([]string, len(columns))
+			for j, column := range columns {
+				record[j] = cellString(row[column])
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeNDJSON writes a JSON object per line for each record. When there are
+// several sections, each record is wrapped in an object keyed by the name of
+// its section.
+func writeNDJSON(w io.Writer, sections []*section) error {
+	encoder := json.NewEncoder(w)
+	for _, s := range sections {
+		for _, row := range s.rows {
+			var line any = row
+			if len(sections) > 1 {
+				line = map[string]any{s.name: row}
+			}
+			if err := encoder.Encode(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cellString formats a value of a record as the text of a cell.
+func cellString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case map[string]any, []any, []map[string]any:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -20,34 +22,318 @@ import (
 )
 
 func NewApp(confBytes []byte) (*App, error) {
+	return newApp(confBytes, nil)
+}
+
+// newApp builds an App from confBytes. When prev is not nil, the connection
+// pools of databases whose type and url did not change are reused from prev.
+func newApp(confBytes []byte, prev *App) (*App, error) {
 	var app *App
 	err := json.Unmarshal(confBytes, &app)
 	if err != nil {
 		return nil, err
 	}
+	if app == nil {
+		return nil, fmt.Errorf("empty configuration")
+	}
 	if app.Web == nil {
 		app.Web = &Web{}
 	}
+	if app.Web.MaxStreamRows <= 0 {
+		app.Web.MaxStreamRows = defaultMaxStreamRows
+	}
+	if app.Web.MaxImportSize <= 0 {
+		app.Web.MaxImportSize = defaultMaxImportSize
+	}
+	if app.Web.MaxTimeout <= 0 {
+		app.Web.MaxTimeout = defaultMaxTimeout
+	}
+	app.accessLogger = newAccessLogger(app.Web.AccessLog)
+	for _, script := range app.Scripts {
+		if script == nil {
+			continue
+		}
+		script.SQL = strings.TrimSpace(script.SQL)
+		script.Path = strings.TrimSpace(script.Path)
+	}
+	if app.SlowQuery != nil {
+		gosqlcrud.SqlSafe(&app.SlowQuery.Table)
+	}
 	for _, table := range app.Tables {
+		if table == nil {
+			continue
+		}
 		gosqlcrud.SqlSafe(&table.Name)
-		if table.PrimaryKey == "" {
-			table.PrimaryKey = "ID"
+		if len(table.PrimaryKey) == 0 {
+			table.PrimaryKey = Columns{"ID"}
+		}
+		for i := range table.PrimaryKey {
+			gosqlcrud.SqlSafe(&table.PrimaryKey[i])
+		}
+	}
+	err = app.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = app.buildCursorKey(prev)
+	if err != nil {
+		return nil, err
+	}
+	for databaseId, database := range app.Databases {
+		database.id = databaseId
+		database.cursorKey = app.cursorKey
+	}
+	err = app.buildJWT()
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		app.metrics = prev.metrics
+		for databaseId, database := range app.Databases {
+			if prevDatabase, ok := prev.Databases[databaseId]; ok {
+				database.reuseConn(prevDatabase)
+			}
 		}
-		gosqlcrud.SqlSafe(&table.PrimaryKey)
+	} else {
+		app.metrics = newMetrics()
+	}
+	err = app.pingDatabases()
+	if err != nil {
+		app.closeDatabases(prev)
+		return nil, err
 	}
 	err = app.buildTokenQuery()
 	if err != nil {
+		app.closeDatabases(prev)
+		return nil, err
+	}
+	err = app.buildSlowQueryLog(prev)
+	if err != nil {
+		app.closeDatabases(prev)
 		return nil, err
 	}
+	if prev != nil {
+		app.tracer = newTracer(app.Tracing, prev.tracer)
+	} else {
+		app.tracer = newTracer(app.Tracing, nil)
+	}
 	return app, nil
 }
 
+func (this *App) validate() error {
+	if this.Web.AccessLog != "" && this.Web.AccessLog != accessLogJSON && this.Web.AccessLog != accessLogLogfmt {
+		return fmt.Errorf("invalid access log format %s", this.Web.AccessLog)
+	}
+	for databaseId, database := range this.Databases {
+		if database == nil {
+			return fmt.Errorf("database %s is empty", databaseId)
+		}
+	}
+	for _, accesses := range this.Tokens {
+		for _, access := range accesses {
+			if access == nil {
+				continue
+			}
+			if err := checkRowFilters(access.RowFilterMap); err != nil {
+				return err
+			}
+		}
+	}
+	if this.SlowQuery != nil && this.SlowQuery.Database != "" {
+		if this.Databases[this.SlowQuery.Database] == nil {
+			return fmt.Errorf("database %s not found for slow query log", this.SlowQuery.Database)
+		}
+		if this.SlowQuery.Table == "" {
+			return fmt.Errorf("table not set for slow query log")
+		}
+	}
+	for scriptId, script := range this.Scripts {
+		if script == nil {
+			return fmt.Errorf("script %s is empty", scriptId)
+		}
+		if script.Database != "" && this.Databases[script.Database] == nil {
+			return fmt.Errorf("database %s not found for script %s", script.Database, scriptId)
+		}
+	}
+	for tableId, table := range this.Tables {
+		if table == nil {
+			return fmt.Errorf("table %s is empty", tableId)
+		}
+		if table.Database != "" && this.Databases[table.Database] == nil {
+			return fmt.Errorf("database %s not found for table %s", table.Database, tableId)
+		}
+		for _, column := range slices.Concat(table.ReadableColumns, table.WritableColumns, table.ConflictColumns) {
+			if !reColumnName.MatchString(column) {
+				return fmt.Errorf("invalid column %s for table %s", column, tableId)
+			}
+		}
+		order, err := parseOrderBy(table.OrderBy)
+		if err != nil {
+			return fmt.Errorf("invalid order_by %s for table %s", table.OrderBy, tableId)
+		}
+		for _, c := range order {
+			if !table.IsColumnExported(c.Column) {
+				return fmt.Errorf("order_by column %s is not exported by table %s", c.Column, tableId)
+			}
+		}
+		for relationId, relation := range table.Relations {
+			if relation == nil {
+				return fmt.Errorf("relation %s of table %s is empty", relationId, tableId)
+			}
+			related := this.Tables[relation.Table]
+			if related == nil || related.Database != table.Database {
+				return fmt.Errorf("table %s not found for relation %s of table %s", relation.Table, relationId, tableId)
+			}
+			if len(relation.ForeignKey) != len(table.PrimaryKey) {
+				return fmt.Errorf("foreign key %s of relation %s does not match primary key %s of table %s", relation.ForeignKey, relationId, table.PrimaryKey, tableId)
+			}
+			for _, column := range relation.ForeignKey {
+				if !reColumnName.MatchString(column) {
+					return fmt.Errorf("invalid column %s for relation %s of table %s", column, relationId, tableId)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// current returns the app that serves requests on the listeners of this app.
+func (this *App) current() *App {
+	if app := this.live.Load(); app != nil {
+		return app
+	}
+	return this
+}
+
+// reload builds a new app from confBytes and swaps it in for the current one.
+// If confBytes is invalid, the current app keeps serving requests.
+func (this *App) reload(confBytes []byte) error {
+	this.reloadMu.Lock()
+	defer this.reloadMu.Unlock()
+	prev := this.current()
+	app, err := newApp(confBytes, prev)
+	if err != nil {
+		return err
+	}
+	if app.Web.HttpAddr != prev.Web.HttpAddr || app.Web.HttpsAddr != prev.Web.HttpsAddr ||
+		app.Web.CertFile != prev.Web.CertFile || app.Web.KeyFile != prev.Web.KeyFile {
+		log.Println("Changes to http_addr, https_addr, cert_file and key_file require a restart.")
+	}
+	app.Web.httpServer = prev.Web.httpServer
+	app.Web.httpsServer = prev.Web.httpsServer
+	this.live.Store(app)
+	app.configurePools()
+	// requests still running on prev keep using its databases until they end
+	drained := prev.retire()
+	select {
+	case <-drained:
+		prev.close(app)
+	default:
+		go func() {
+			<-drained
+			prev.close(app)
+		}()
+	}
+	return nil
+}
+
+// acquire returns the current app, counting a request on it until release.
+func (this *App) acquire() *App {
+	for {
+		app := this.current()
+		app.requestsMu.Lock()
+		if !app.retired {
+			app.requests++
+			app.requestsMu.Unlock()
+			return app
+		}
+		// swapped out since it was loaded, the next one is current
+		app.requestsMu.Unlock()
+	}
+}
+
+func (this *App) release() {
+	this.requestsMu.Lock()
+	defer this.requestsMu.Unlock()
+	this.requests--
+	if this.retired && this.requests == 0 {
+		close(this.drained)
+	}
+}
+
+// retire stops new requests from running on this, and returns a channel that
+// is closed once the requests running on it have ended.
+func (this *App) retire() <-chan struct{} {
+	this.requestsMu.Lock()
+	defer this.requestsMu.Unlock()
+	this.retired = true
+	this.drained = make(chan struct{})
+	if this.requests == 0 {
+		close(this.drained)
+	}
+	return this.drained
+}
+
+// close closes the connection pools, slow query log and tracer of this app that
+// are not shared with other.
+func (this *App) close(other *App) {
+	// the slow query log writes its queued entries before the databases close
+	if other == nil {
+		this.slowQueryLog.close(nil)
+		this.closeDatabases(nil)
+		this.tracer.stop()
+		return
+	}
+	this.slowQueryLog.close(other.slowQueryLog)
+	this.closeDatabases(other)
+	if this.tracer != other.tracer {
+		this.tracer.stop()
+	}
+}
+
+func (this *App) reloadFile(confPath string) {
+	confBytes, err := os.ReadFile(confPath)
+	if err != nil {
+		log.Printf("Failed to reload %s, %v\n", confPath, err)
+		return
+	}
+	err = this.reload(confBytes)
+	if err != nil {
+		log.Printf("Failed to reload %s, %v\n", confPath, err)
+		return
+	}
+	log.Printf("Reloaded %s\n", confPath)
+}
+
+// closeDatabases closes the connection pools of this app that are not shared
+// with other.
+func (this *App) closeDatabases(other *App) {
+	for databaseId, database := range this.Databases {
+		database.mu.Lock()
+		conn := database.conn
+		replicas := database.replicas
+		database.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+		if other != nil {
+			if otherDatabase, ok := other.Databases[databaseId]; ok && otherDatabase.conn == conn {
+				continue
+			}
+		}
+		conn.Close()
+		replicas.close()
+	}
+}
+
 func (this *App) run() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/{db}/{obj}", this.defaultHandler)
-	mux.HandleFunc("/{db}/{obj}/", this.defaultHandler)
-	mux.HandleFunc("/{db}/{obj}/{key}", this.defaultHandler)
-	mux.HandleFunc("/{db}/{obj}/{key}/", this.defaultHandler)
+	mux.HandleFunc("GET /.openapi.json", this.serve((*App).openAPIHandler))
+	mux.HandleFunc("GET /.metrics", this.serve((*App).metricsHandler))
+	mux.HandleFunc("/{db}/{obj}", this.serve((*App).defaultHandler))
+	mux.HandleFunc("/{db}/{obj}/", this.serve((*App).defaultHandler))
+	mux.HandleFunc("/{db}/{obj}/{key}", this.serve((*App).defaultHandler))
+	mux.HandleFunc("/{db}/{obj}/{key}/", this.serve((*App).defaultHandler))
 
 	if this.Web.HttpAddr != "" {
 		this.Web.httpServer = &http.Server{
@@ -93,10 +379,16 @@ func (this *App) shutdown() {
 	if this.Web.httpsServer != nil {
 		this.Web.httpsServer.Shutdown(ctx)
 	}
-	for _, database := range this.Databases {
-		if database.conn != nil {
-			database.conn.Close()
-		}
+	this.current().close(nil)
+}
+
+// serve returns a handler that dispatches requests to the current app, which
+// is not closed by a reload before they end.
+func (this *App) serve(handler func(*App, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app := this.acquire()
+		defer app.release()
+		handler(app, w, r)
 	}
 }
 
@@ -120,22 +412,47 @@ func (this *Database) GetConn() (*sql.DB, error) {
 		return this.conn, nil
 	}
 	var err error
-	if strings.HasPrefix(this.Type, "env:") {
-		env := strings.TrimPrefix(this.Type, "env:")
-		this.Type = os.Getenv(env)
-	}
-	if strings.HasPrefix(this.Url, "env:") {
-		env := strings.TrimPrefix(this.Url, "env:")
-		this.Url = os.Getenv(env)
+	this.Type = resolveEnv(this.Type)
+	this.Url = resolveEnv(this.Url)
+	this.conn, err = this.openDB(this.Url)
+	if err != nil {
+		return nil, err
 	}
-	this.conn, err = sql.Open(this.Type, this.Url)
+	err = this.openReplicas()
 	if err != nil {
+		this.conn.Close()
+		this.conn = nil
 		return nil, err
 	}
+	this.configurePool()
 	this.dbType = gosqlcrud.GetDbType(this.conn)
 	return this.conn, err
 }
 
+// reuseConn takes over the connection pools of prev if both point to the same
+// primary and replicas with the same init SQL. The pool settings of this are
+// applied by configurePools once this is live, as prev keeps serving requests
+// if this is rejected.
+func (this *Database) reuseConn(prev *Database) {
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	sameReplicas := slices.EqualFunc(this.Replicas, prev.Replicas, func(url string, prevUrl string) bool {
+		return resolveEnv(url) == prevUrl
+	})
+	if prev.conn == nil || resolveEnv(this.Type) != prev.Type || resolveEnv(this.Url) != prev.Url ||
+		!slices.Equal(this.InitSQL, prev.InitSQL) || !sameReplicas {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.Type = prev.Type
+	this.Url = prev.Url
+	this.Replicas = prev.Replicas
+	this.conn = prev.conn
+	this.replicas = prev.replicas
+	this.dbType = prev.dbType
+}
+
 func (this *Database) GetLimitClause(limit int, offset int) string {
 	switch this.dbType {
 	case gosqlcrud.PostgreSQL, gosqlcrud.MySQL, gosqlcrud.SQLite:
@@ -146,6 +463,31 @@ func (this *Database) GetLimitClause(limit int, offset int) string {
 	return ""
 }
 
+// GetStatements returns the statements of script, building them on first use.
+func (this *Database) GetStatements(script *Script) ([]*Statement, error) {
+	script.mu.Lock()
+	defer script.mu.Unlock()
+
+	if os.Getenv("env") == "dev" {
+		script.built = false
+	}
+
+	if !script.built {
+		if script.Path != "" {
+			f, err := os.ReadFile(script.Path)
+			if err != nil {
+				return nil, err
+			}
+			script.SQL = string(f)
+		}
+		err := this.BuildStatements(script)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return script.Statements, nil
+}
+
 func (this *Database) BuildStatements(script *Script) error {
 	script.Statements = nil
 	script.built = false
@@ -241,13 +583,26 @@ func (this *App) buildTokenQuery() error {
 			this.ManagedTokens.AllowedOrigins = "ALLOWED_ORIGINS"
 		}
 
+		// the following columns are optional, so they are only selected when configured
+		optionalColumns := ""
+		for _, column := range [][2]string{
+			{this.ManagedTokens.RowFilters, "row_filters"},
+			{this.ManagedTokens.ReadableColumns, "readable_columns"},
+			{this.ManagedTokens.WritableColumns, "writable_columns"},
+		} {
+			if column[0] != "" {
+				optionalColumns += fmt.Sprintf(`,
+			%s AS "%s"`, column[0], column[1])
+			}
+		}
+
 		this.ManagedTokens.Query = fmt.Sprintf(`SELECT
 			%s AS "target_database",
 			%s AS "target_objects",
 			%s AS "read_private",
 			%s AS "write_private",
 			%s AS "exec_private",
-			%s AS "allowed_origins"
+			%s AS "allowed_origins"%s
 			FROM %s WHERE %s=?token?`,
 			this.ManagedTokens.TargetDatabase,
 			this.ManagedTokens.TargetObjects,
@@ -255,6 +610,7 @@ func (this *App) buildTokenQuery() error {
 			this.ManagedTokens.WritePrivate,
 			this.ManagedTokens.ExecPrivate,
 			this.ManagedTokens.AllowedOrigins,
+			optionalColumns,
 			this.ManagedTokens.TableName,
 			this.ManagedTokens.Token)
 	}
@@ -276,19 +632,16 @@ func (this *App) buildTokenQuery() error {
 	return nil
 }
 
-func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
+func (this *App) setCorsHeaders(w http.ResponseWriter, r *http.Request) {
 	if this.Web.Cors {
 		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
 		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
 	}
+}
 
-	if r.Method == "OPTIONS" {
-		w.Header().Set("Allow", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-		return
-	}
-
+func (this *App) setHeaders(w http.ResponseWriter) {
 	if this.Web.HttpHeaders != nil {
 		for k, v := range this.Web.HttpHeaders {
 			w.Header().Set(k, v)
@@ -298,12 +651,34 @@ func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("gosqlapi-server-version", version)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+}
 
-	authorization := r.Header.Get("authorization")
-	if strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
-		authorization = strings.TrimSpace(authorization[7:])
+func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
+	recorder := &responseRecorder{ResponseWriter: w, requestId: requestId(r)}
+	defer this.finishRequest(recorder, r, time.Now())
+	w = recorder
+	w.Header().Set("X-Request-Id", recorder.requestId)
+
+	ctx, serverSpan := this.tracer.startServerSpan(r, r.Method+" "+r.Pattern)
+	defer func() { finishServerSpan(serverSpan, recorder.statusCode()) }()
+	serverSpan.setAttribute("http.request.method", r.Method)
+	serverSpan.setAttribute("url.path", r.URL.Path)
+	serverSpan.setAttribute("gosqlapi.db", r.PathValue("db"))
+	serverSpan.setAttribute("gosqlapi.object", r.PathValue("obj"))
+	serverSpan.setAttribute("gosqlapi.request_id", recorder.requestId)
+	r = r.WithContext(ctx)
+
+	this.setCorsHeaders(w, r)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+		return
 	}
 
+	this.setHeaders(w)
+
+	authorization := requestToken(r)
+
 	databaseId := r.PathValue("db")
 
 	if this.CacheTokens && databaseId == ".clear-tokens" && authorization != "" {
@@ -343,13 +718,14 @@ func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		referer = refererUrl.Hostname()
 	}
-	authorized, err := this.authorize(methodUpper, authorization, databaseId, objectId, origin, referer)
-	if !authorized {
-		msg := "access denied"
-		if err != nil {
-			msg = err.Error()
-		}
-		writeJSONError(w, http.StatusUnauthorized, msg)
+	access, err := this.authorize(ctx, methodUpper, authorization, databaseId, objectId, origin, referer)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if format := importFormat(r); format != "" && methodUpper == http.MethodPost && this.Tables[objectId] != nil {
+		this.importTable(w, r, format, database, this.Tables[objectId], access)
 		return
 	}
 
@@ -361,11 +737,23 @@ func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var bodyData map[string]any
+	var bodyRows []any
 	if len(body) > 0 {
-		if err := json.Unmarshal(body, &bodyData); err != nil {
+		var bodyValue any
+		if err := json.Unmarshal(body, &bodyValue); err != nil {
 			writeJSONError(w, http.StatusBadRequest, "invalid JSON in request body")
 			return
 		}
+		switch v := bodyValue.(type) {
+		case map[string]any:
+			bodyData = v
+		case []any:
+			bodyRows = v
+		case nil:
+		default:
+			writeJSONError(w, http.StatusBadRequest, "request body must be a JSON object or array")
+			return
+		}
 	}
 
 	paramValues, err := url.ParseQuery(r.URL.RawQuery)
@@ -377,56 +765,90 @@ func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
 	for k, v := range bodyData {
 		params[k] = v
 	}
+	// the written record is only returned by POST and PUT of tables
+	preferred := preferRepresentation(r) && (methodUpper == http.MethodPost || methodUpper == http.MethodPut)
+	if preferred {
+		params[".returning"] = true
+	}
+
+	format, err := responseFormat(r, params)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format != formatJSON {
+		// CSV and XLSX have the columns in the order of the queries
+		ctx = withColumnOrder(ctx)
+		r = r.WithContext(ctx)
+	}
+	var stream *rowStreamer
+	if paramBool(params[".stream"], false) {
+		stream, err = newRowStreamer(w, format, this.Web.MaxStreamRows)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
 	var result any
+	isScript := methodUpper == http.MethodPatch || (methodUpper == http.MethodGet && this.Tables[objectId] == nil)
+	isList := false
+
+	objectTimeout := 0
+	if script := this.Scripts[objectId]; isScript && script != nil {
+		objectTimeout = script.Timeout
+	} else if table := this.Tables[objectId]; !isScript && table != nil {
+		objectTimeout = table.Timeout
+	}
+	timeout, err := this.requestTimeout(database, objectTimeout, params)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
 
-	if methodUpper == http.MethodPatch || (methodUpper == http.MethodGet && this.Tables[objectId] == nil) {
+	if isScript {
 		script := this.Scripts[objectId]
 		if script == nil {
 			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("script %s not found", objectId))
 			return
 		}
-		script.mu.Lock()
-		script.SQL = strings.TrimSpace(script.SQL)
-		script.Path = strings.TrimSpace(script.Path)
-
-		if os.Getenv("env") == "dev" {
-			script.built = false
+		if bodyRows != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("script %s does not accept an array", objectId))
+			return
 		}
-
-		if !script.built {
-			if script.SQL == "" && script.Path == "" {
-				script.mu.Unlock()
-				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("script %s is empty", objectId))
-				return
-			}
-
-			if script.Path != "" {
-				f, err := os.ReadFile(script.Path)
-				if err != nil {
-					script.mu.Unlock()
-					writeJSONError(w, http.StatusInternalServerError, err.Error())
-					return
-				}
-				script.SQL = string(f)
-			}
-
-			err = database.BuildStatements(script)
-			if err != nil {
-				script.mu.Unlock()
-				writeJSONError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			this.Scripts[objectId] = script
+		// script.SQL is only rewritten when script.Path is set
+		if script.Path == "" && script.SQL == "" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("script %s is empty", objectId))
+			return
 		}
-		statements := script.Statements
-		script.mu.Unlock()
-
-		result, err = runExec(database, statements, params, r)
+		statements, err := database.GetStatements(script)
 		if err != nil {
 			writeJSONError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+
+		result, err = runExec(database, statements, params, r, stream)
+		if err != nil {
+			if stream != nil && stream.started() {
+				stream.abort(err)
+			}
+			err = contextError(ctx, err, timeout)
+			writeJSONError(w, errorStatus(err, http.StatusInternalServerError), err.Error())
+			return
+		}
+		if stream != nil {
+			setRows(w, int64(stream.rows))
+			if err := stream.finish(); err != nil {
+				stream.abort(err)
+			}
+			return
+		}
 	} else {
 		dataId := r.PathValue("key")
 		table := this.Tables[objectId]
@@ -434,9 +856,63 @@ func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
 			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("table %s not found", objectId))
 			return
 		}
-		result, err = runTable(methodUpper, database, table, dataId, params)
+		rowFilters, err := access.RowFilterValues(r)
 		if err != nil {
-			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		key, err := table.ParseKey(dataId)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if key == nil && bodyRows == nil && (methodUpper == http.MethodPut || methodUpper == http.MethodDelete) {
+			key = table.KeyFromQuery(paramValues, params)
+		}
+		var embeds []*embedding
+		if embedParam, ok := params[".embed"]; ok && methodUpper == http.MethodGet {
+			embeds, err = this.embeddings(table, fmt.Sprint(embedParam), authorization, databaseId, origin, referer, r)
+			if err != nil {
+				writeJSONError(w, errorStatus(err, http.StatusInternalServerError), err.Error())
+				return
+			}
+		}
+		if bodyRows != nil {
+			if dataId != "" {
+				writeJSONError(w, http.StatusBadRequest, "an array is not accepted with a key in the path")
+				return
+			}
+			result, err = runTableBulk(ctx, methodUpper, database, table, params, bodyRows, access, rowFilters)
+			if err != nil {
+				err = contextError(ctx, err, timeout)
+				var rowError *RowError
+				if errors.As(err, &rowError) {
+					writeJSONRowError(w, errorStatus(err, http.StatusInternalServerError), rowError.Err.Error(), rowError.Index)
+				} else {
+					writeJSONError(w, errorStatus(err, http.StatusInternalServerError), err.Error())
+				}
+				return
+			}
+		} else {
+			isList = methodUpper == http.MethodGet && key == nil
+			if !isList {
+				stream = nil
+			}
+			result, err = runTable(ctx, methodUpper, database, table, key, params, access, rowFilters, embeds, stream)
+		}
+		if err != nil {
+			if stream != nil && stream.started() {
+				stream.abort(err)
+			}
+			err = contextError(ctx, err, timeout)
+			writeJSONError(w, errorStatus(err, http.StatusInternalServerError), err.Error())
+			return
+		}
+		if stream != nil {
+			setRows(w, int64(stream.rows))
+			if err := stream.finish(); err != nil {
+				stream.abort(err)
+			}
 			return
 		}
 		if result == nil {
@@ -446,6 +922,26 @@ func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
 			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("record %s not found for database %s and object %s", dataId, databaseId, objectId))
 			return
 		}
+		if preferred {
+			w.Header().Set("Preference-Applied", "return=representation")
+		}
+	}
+
+	setRows(w, countRows(result, isScript, isList))
+
+	if format != formatJSON {
+		label := ""
+		if table := this.Tables[objectId]; !isScript && table != nil {
+			label = table.Name + " get"
+			if isList {
+				label = table.Name + " list"
+			}
+		}
+		err = writeSections(w, format, objectId, resultSections(ctx, objectId, label, result, isScript, isList))
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
 	}
 
 	jsonData, err := json.Marshal(result)
@@ -457,31 +953,47 @@ func (this *App) defaultHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, jsonString)
 }
 
-func (this *App) authorize(methodUpper string, authorization string, databaseId string, objectId string, origin string, referer string) (bool, error) {
+// authorize returns the access granted to authorization for the object, or nil
+// if the object is public.
+func (this *App) authorize(ctx context.Context, methodUpper string, authorization string, databaseId string, objectId string, origin string, referer string) (access *Access, err error) {
+	ctx, authSpan := startSpan(ctx, "authorize", spanKindInternal)
+	defer func() {
+		authSpan.setError(err)
+		authSpan.finish()
+	}()
 
-	// if object is not found, return false
+	// if object is not found, return an error
 	// if object is found, check if it is public
-	// if object is public, return true regardless of token
+	// if object is public, return no access and no error regardless of token
 	// if database is not specified in object, the object is shared across all databases
 	if methodUpper == http.MethodPatch || (methodUpper == http.MethodGet && this.Tables[objectId] == nil) {
 		script := this.Scripts[objectId]
 		if script == nil || (script.Database != "" && script.Database != databaseId) {
-			return false, fmt.Errorf("script %s not found", objectId)
+			return this.authFailed(authObjectNotFound, fmt.Errorf("script %s not found", objectId))
 		}
 		if script.PublicExec {
-			return true, nil
+			return nil, nil
 		}
 	} else {
 		table := this.Tables[objectId]
 		if table == nil || (table.Database != "" && table.Database != databaseId) {
-			return false, fmt.Errorf("table %s not found", objectId)
+			return this.authFailed(authObjectNotFound, fmt.Errorf("table %s not found", objectId))
 		}
 		if table.PublicRead && methodUpper == http.MethodGet {
-			return true, nil
+			return nil, nil
 		}
 		if table.PublicWrite && (methodUpper == http.MethodPost || methodUpper == http.MethodPut || methodUpper == http.MethodDelete) {
-			return true, nil
+			return nil, nil
+		}
+	}
+
+	// jwt
+	if this.JWT != nil && isJWT(authorization) {
+		access, err := this.JWT.Access(authorization)
+		if err != nil {
+			return this.authFailed(authInvalidJWT, err)
 		}
+		return this.hasAccess(methodUpper, []*Access{access}, databaseId, objectId, origin, referer)
 	}
 
 	// managed tokens
@@ -490,28 +1002,41 @@ func (this *App) authorize(methodUpper string, authorization string, databaseId
 			this.tokenCacheMu.RLock()
 			x, ok := this.tokenCache[authorization]
 			this.tokenCacheMu.RUnlock()
+			this.metrics.tokenCacheLookup(ok)
+			authSpan.setAttribute("gosqlapi.token_cache.hit", ok)
 			if ok {
 				return this.hasAccess(methodUpper, x, databaseId, objectId, origin, referer)
 			}
 		}
 		managedTokensDatabase, err := this.GetDatabase(this.ManagedTokens.Database)
 		if err != nil {
-			return false, err
+			return this.authFailed(authTokenLookup, err)
 		}
 		tokenDB, err := managedTokensDatabase.GetConn()
 		if err != nil {
-			return false, err
+			return this.authFailed(authTokenLookup, err)
 		}
 
 		accesses := []Access{}
-		err = gosqlcrud.QueryToStructs(tokenDB, &accesses, this.ManagedTokens.Query, authorization)
+		_, lookupSpan := startSpan(ctx, "token lookup", spanKindClient)
+		lookupSpan.setAttribute("db.system", dbSystems[managedTokensDatabase.dbType])
+		lookupSpan.setAttribute("db.namespace", this.ManagedTokens.Database)
+		err = gosqlcrud.QueryToStructs(withContext(ctx, tokenDB), &accesses, this.ManagedTokens.Query, authorization)
+		lookupSpan.setError(err)
+		lookupSpan.finish()
 		if err != nil {
-			return false, err
+			return this.authFailed(authTokenLookup, err)
 		}
 		for index := range accesses {
 			access := &accesses[index]
 			access.TargetObjectArray = strings.Fields(access.TargetObjects)
 			access.AllowedOriginArray = strings.Fields(access.AllowedOrigins)
+			access.RowFilterMap, err = parseRowFilters(access.RowFilters)
+			if err != nil {
+				return this.authFailed(authTokenLookup, err)
+			}
+			access.ReadableColumnArray = strings.Fields(access.ReadableColumns)
+			access.WritableColumnArray = strings.Fields(access.WritableColumns)
 		}
 		x := ArrayOfStructsToArrayOfPointersOfStructs(accesses)
 		if this.CacheTokens {
@@ -529,7 +1054,7 @@ func (this *App) authorize(methodUpper string, authorization string, databaseId
 	// if token doesn't have any access, return false
 	accesses := this.Tokens[authorization]
 	if len(accesses) == 0 {
-		return false, fmt.Errorf("access denied")
+		return this.authFailed(authTokenNotFound, fmt.Errorf("access denied"))
 	} else {
 		// when token has access, check if any access is allowed for database and object
 		return this.hasAccess(methodUpper, accesses, databaseId, objectId, origin, referer)
@@ -555,7 +1080,7 @@ func originOk(origin string, referer string, allowedOrigins []string) bool {
 	return false
 }
 
-func (this *App) hasAccess(methodUpper string, accesses []*Access, databaseId string, objectId string, origin string, referer string) (bool, error) {
+func (this *App) hasAccess(methodUpper string, accesses []*Access, databaseId string, objectId string, origin string, referer string) (*Access, error) {
 	for _, access := range accesses {
 		if (access.TargetDatabase == databaseId || access.TargetDatabase == "*") &&
 			(Contains(access.TargetObjectArray, objectId) || Contains(access.TargetObjectArray, "*")) &&
@@ -563,37 +1088,191 @@ func (this *App) hasAccess(methodUpper string, accesses []*Access, databaseId st
 			switch methodUpper {
 			case http.MethodPatch:
 				if access.ExecPrivate {
-					return true, nil
+					return access, nil
 				}
 			case http.MethodGet:
 				if this.Tables[objectId] == nil {
 					if access.ExecPrivate {
-						return true, nil
+						return access, nil
 					}
 				} else {
 					if access.ReadPrivate {
-						return true, nil
+						return access, nil
 					}
 				}
 			case http.MethodPost, http.MethodPut, http.MethodDelete:
 				if access.WritePrivate {
-					return true, nil
+					return access, nil
 				}
 			}
 		}
 	}
-	return false, fmt.Errorf("access token not allowed for database %s and object %s", databaseId, objectId)
+	reason := authNotAllowed
+	if len(accesses) == 0 {
+		reason = authTokenNotFound
+	}
+	return this.authFailed(reason, fmt.Errorf("access token not allowed for database %s and object %s", databaseId, objectId))
+}
+
+// RowFilterValues resolves the row filters of the access for request r. Values
+// in the form of !name! are taken from the request metadata, and values in the
+// form of $name from the claims of a JWT.
+func (this *Access) RowFilterValues(r *http.Request) (map[string]any, error) {
+	if this == nil || len(this.RowFilterMap) == 0 {
+		return nil, nil
+	}
+	rowFilters := map[string]any{}
+	for column, value := range this.RowFilterMap {
+		if m := reRequestParam.FindStringSubmatch(value); m != nil && m[0] == value {
+			rowFilters[column] = GetMetaDataFromRequest(m[1], r)
+		} else if strings.HasPrefix(value, "$") {
+			claim, ok := this.claims[value[1:]]
+			if !ok {
+				return nil, fmt.Errorf("claim %s not found for row filter on %s", value[1:], column)
+			}
+			rowFilters[column] = claim
+		} else {
+			rowFilters[column] = value
+		}
+	}
+	return rowFilters, nil
+}
+
+// IsColumnExported reports whether column is one of the exported columns of
+// the table, matching `NAME AS USERNAME` by its source column NAME.
+func (this *Table) IsColumnExported(column string) bool {
+	return columnAllowed(this.ExportedColumns, column)
+}
+
+// columnAllowed reports whether column is in columns, matching `NAME AS
+// USERNAME` by its source column NAME. Empty columns allow all columns.
+func columnAllowed(columns []string, column string) bool {
+	if len(columns) == 0 {
+		return true
+	}
+	for _, c := range columns {
+		fields := strings.Fields(c)
+		if len(fields) > 0 && strings.EqualFold(fields[0], column) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetReadableColumns returns the columns access can read from the table, or nil
+// if all columns are readable. Columns of the access override the columns of
+// the table.
+func (this *Table) GetReadableColumns(access *Access) []string {
+	if access != nil && len(access.ReadableColumnArray) > 0 {
+		return safeColumns(access.ReadableColumnArray)
+	}
+	return this.ReadableColumns
+}
+
+// GetWritableColumns returns the columns access can write to the table, or nil
+// if all columns are writable. Columns of the access override the columns of
+// the table.
+func (this *Table) GetWritableColumns(access *Access) []string {
+	if access != nil && len(access.WritableColumnArray) > 0 {
+		return safeColumns(access.WritableColumnArray)
+	}
+	return this.WritableColumns
 }
 
-func runTable(method string, database *Database, table *Table, dataId string, params map[string]any) (any, error) {
-	gosqlcrud.SqlSafe(&dataId)
-	db, err := database.GetConn()
+// safeColumns drops anything that is not a plain column name, so that columns
+// from managed tokens and JWT claims cannot inject SQL. If nothing is left,
+// a column that cannot exist is returned so that no column is allowed.
+func safeColumns(columns []string) []string {
+	ret := []string{}
+	for _, column := range columns {
+		if reColumnName.MatchString(column) {
+			ret = append(ret, column)
+		}
+	}
+	if len(ret) == 0 {
+		return []string{"-"}
+	}
+	return ret
+}
+
+// ListColumns returns the columns selected by list reads, which are the
+// exported columns that are readable.
+func (this *Table) ListColumns(readableColumns []string) ([]string, error) {
+	if len(this.ExportedColumns) == 0 {
+		return readableColumns, nil
+	}
+	columns := []string{}
+	for _, exportedColumn := range this.ExportedColumns {
+		fields := strings.Fields(exportedColumn)
+		if len(fields) > 0 && columnAllowed(readableColumns, fields[0]) {
+			columns = append(columns, exportedColumn)
+		}
+	}
+	if len(columns) == 0 {
+		return nil, &StatusError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("no readable columns")}
+	}
+	return columns, nil
+}
+
+// checkColumns rejects parameters that refer to columns outside of columns.
+// Parameters starting with . are options, and filters such as `age.gt` are
+// checked by their column.
+func checkColumns(params map[string]any, columns []string, action string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	for k := range params {
+		if strings.HasPrefix(k, ".") {
+			continue
+		}
+		column, _, _ := strings.Cut(k, ".")
+		if !columnAllowed(columns, column) {
+			return badRequest("column %s is not %s", column, action)
+		}
+	}
+	return nil
+}
+
+// rowFilterWhere builds the WHERE conditions that restrict a table operation to
+// the rows allowed by rowFilters. Placeholders are numbered from startIndex.
+func (this *Database) rowFilterWhere(rowFilters map[string]any, startIndex int) (string, []any, error) {
+	if len(rowFilters) == 0 {
+		return "", nil, nil
+	}
+	return gosqlcrud.MapForSqlWhere(rowFilters, startIndex, this.dbType)
+}
+
+// deleteDotParams removes the request options, which start with a dot, from
+// params.
+func deleteDotParams(params map[string]any) {
+	for k := range params {
+		if strings.HasPrefix(k, ".") {
+			delete(params, k)
+		}
+	}
+}
+
+// forceRowFilters overwrites the values in params for the columns in
+// rowFilters, so that rows cannot be written outside of the row filters.
+func forceRowFilters(params map[string]any, rowFilters map[string]any) {
+	for column, value := range rowFilters {
+		for k := range params {
+			if strings.EqualFold(k, column) {
+				delete(params, k)
+			}
+		}
+		params[column] = value
+	}
+}
+
+func runTable(ctx context.Context, method string, database *Database, table *Table, key []any, params map[string]any, access *Access, rowFilters map[string]any, embeds []*embedding, stream *rowStreamer) (any, error) {
+	db, err := database.getConn(method == http.MethodGet, params)
 	if err != nil {
 		return nil, err
 	}
 	switch method {
 	case http.MethodGet:
-		if dataId == "" {
+		if key == nil {
 			pageSize := 0
 			switch _pageSize := params[".page_size"].(type) {
 			case string:
@@ -608,6 +1287,10 @@ func runTable(method string, database *Database, table *Table, dataId string, pa
 			case float64:
 				pageSize = int(_pageSize)
 			}
+			if pageSize <= 0 && stream != nil {
+				// streamed lists are only limited by the row cap
+				pageSize = stream.maxRows + 1
+			}
 			if pageSize <= 0 {
 				pageSize = table.PageSize
 			}
@@ -635,15 +1318,71 @@ func runTable(method string, database *Database, table *Table, dataId string, pa
 
 			limitClause := database.GetLimitClause(pageSize, offset)
 
-			orderBy := params[".order_by"]
-			if orderBy == nil {
+			if stream != nil {
+				for _, param := range []string{".cursor", ".show_total", ".embed"} {
+					if _, ok := params[param]; ok {
+						return nil, badRequest("%s cannot be used with .stream", param)
+					}
+				}
+			}
+
+			readableColumns := table.GetReadableColumns(access)
+			err = checkColumns(params, readableColumns, "readable")
+			if err != nil {
+				return nil, err
+			}
+
+			// grouped lists are not ordered by the default order of the table,
+			// which refers to columns that are not grouped
+			groupByParam, grouped := params[".group_by"]
+			aggregateParam, aggregated := params[".aggregate"]
+			// the default order of the table is checked when the
+			// configuration is loaded
+			orderBy, requested := params[".order_by"]
+			if !requested && !grouped && !aggregated {
 				orderBy = table.OrderBy
 			}
+			if orderBy == nil {
+				orderBy = ""
+			}
+			order, err := parseOrderBy(fmt.Sprint(orderBy))
+			if err != nil {
+				return nil, err
+			}
+			var groups *grouping
+			if grouped || aggregated {
+				for _, param := range []string{".cursor", ".select", ".embed"} {
+					if _, ok := params[param]; ok {
+						return nil, badRequest("%s cannot be used with .group_by or .aggregate", param)
+					}
+				}
+				groupColumns, err := table.ListColumns(readableColumns)
+				if err != nil {
+					return nil, err
+				}
+				if groupByParam == nil {
+					groupByParam = ""
+				}
+				if aggregateParam == nil {
+					aggregateParam = ""
+				}
+				groups, err = database.parseGrouping(table, fmt.Sprint(groupByParam), fmt.Sprint(aggregateParam), groupColumns)
+				if err != nil {
+					return nil, err
+				}
+				err = groups.checkOrder(order)
+				if err != nil {
+					return nil, err
+				}
+			} else if requested {
+				err = database.checkOrder(table, order, readableColumns)
+				if err != nil {
+					return nil, err
+				}
+			}
 			orderbyClause := ""
-			if orderBy != nil && orderBy != "" {
-				orderByStr := fmt.Sprintf("%s", orderBy)
-				gosqlcrud.SqlSafe(&orderByStr)
-				orderbyClause = fmt.Sprintf("ORDER BY %s", orderByStr)
+			if len(order) > 0 {
+				orderbyClause = database.orderByClause(order)
 			}
 
 			if database.Type == "sqlserver" {
@@ -653,44 +1392,76 @@ func runTable(method string, database *Database, table *Table, dataId string, pa
 			}
 
 			gosqlcrud.SqlSafe(&limitClause)
-			gosqlcrud.SqlSafe(&orderbyClause)
 
-			where, values, err := gosqlcrud.MapForSqlWhere(params, 0, database.dbType)
+			equalParams, filterParams := splitFilterParams(params)
+			where, values, err := gosqlcrud.MapForSqlWhere(equalParams, 0, database.dbType)
+			if err != nil {
+				return nil, err
+			}
+			filterWhere, filterValues, err := database.BuildFilterWhere(table, filterParams, len(values))
+			if err != nil {
+				return nil, err
+			}
+			where += filterWhere
+			values = append(values, filterValues...)
+			rowWhere, rowValues, err := database.rowFilterWhere(rowFilters, len(values))
 			if err != nil {
 				return nil, err
 			}
+			where += rowWhere
+			values = append(values, rowValues...)
 
+			listColumns, err := table.ListColumns(readableColumns)
+			if err != nil {
+				return nil, err
+			}
+			if selectParam, ok := params[".select"]; ok {
+				listColumns, err = database.selectColumns(table, fmt.Sprint(selectParam), listColumns)
+				if err != nil {
+					return nil, err
+				}
+			}
 			columns := "*"
-			if len(table.ExportedColumns) > 0 {
-				columns = strings.Join(table.ExportedColumns, ", ")
+			if len(listColumns) > 0 {
+				columns = strings.Join(listColumns, ", ")
+			}
+			groupByClause := ""
+			if groups != nil {
+				columns = groups.columns()
+				groupByClause = groups.groupByClause()
 			}
 			gosqlcrud.SqlSafe(&columns)
 
-			q := fmt.Sprintf(`SELECT %s FROM %s WHERE 1=1 %s %s %s`, columns, table.Name, where, orderbyClause, limitClause)
-			data, err := gosqlcrud.QueryToMaps(db, q, values...)
-			if err != nil {
+			q := fmt.Sprintf(`SELECT %s FROM %s WHERE 1=1 %s %s %s %s`, columns, table.Name, where, groupByClause, orderbyClause, limitClause)
+			if stream != nil {
+				done := database.startStatement(ctx, table.Name+" list", q, nil, values)
+				err := stream.query(withContext(ctx, db), "", q, values...)
+				done(int64(stream.rows), err)
 				return nil, err
 			}
 
-			showTotal := false
-			switch _showTotal := params[".show_total"].(type) {
-			case string:
-				showTotal = _showTotal == "true" || _showTotal == "1" || _showTotal == "yes"
-			case bool:
-				showTotal = _showTotal
-			case int:
-				showTotal = _showTotal == 1
-			case int64:
-				showTotal = _showTotal == 1
-			case float64:
-				showTotal = _showTotal == 1
-			case nil:
-				showTotal = table.ShowTotal
+			var data []map[string]any
+			var nextCursor any
+			cursorParam, keyset := params[".cursor"]
+			if keyset && groups == nil {
+				cursorString, _ := cursorParam.(string)
+				data, nextCursor, err = database.keysetPage(ctx, db, table, columns, where, values, pageSize, order, cursorString)
+			} else {
+				data, err = database.queryToMaps(ctx, db, table.Name+" list", nil, q, values...)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := embedRows(ctx, db, database, table, data, embeds); err != nil {
+				return nil, err
 			}
 
-			if showTotal {
+			if paramBool(params[".show_total"], table.ShowTotal) {
 				qt := fmt.Sprintf(`SELECT COUNT(*) AS "total" FROM %s WHERE 1=1 %s`, table.Name, where)
-				_total, err := gosqlcrud.QueryToMaps(db, qt, values...)
+				if groups != nil {
+					qt = fmt.Sprintf(`SELECT COUNT(*) AS "total" FROM (SELECT 1 AS ONE FROM %s WHERE 1=1 %s %s) G`, table.Name, where, groupByClause)
+				}
+				_total, err := database.queryToMaps(ctx, db, table.Name+" count", nil, qt, values...)
 				if err != nil {
 					return nil, err
 				}
@@ -715,56 +1486,193 @@ func runTable(method string, database *Database, table *Table, dataId string, pa
 					total = int(v)
 				}
 
+				if keyset {
+					return map[string]any{
+						"total":       total,
+						"page_size":   pageSize,
+						"next_cursor": nextCursor,
+						"data":        data,
+					}, nil
+				}
 				return map[string]any{
 					"total":     total,
 					"page_size": pageSize,
 					"offset":    offset,
 					"data":      data,
 				}, nil
+			} else if keyset {
+				return map[string]any{
+					"page_size":   pageSize,
+					"next_cursor": nextCursor,
+					"data":        data,
+				}, nil
 			} else {
 				return data, nil
 			}
 		} else {
-			placeholder := gosqlcrud.GetPlaceHolder(0, database.dbType)
-			r, err := gosqlcrud.QueryToMaps(db, fmt.Sprintf(`SELECT * FROM %s WHERE %s=%s`, table.Name, table.PrimaryKey, placeholder), dataId)
-			if err != nil {
+			columns := table.GetReadableColumns(access)
+			if selectParam, ok := params[".select"]; ok {
+				columns, err = database.selectColumns(table, fmt.Sprint(selectParam), columns)
+				if err != nil {
+					return nil, err
+				}
+			}
+			r, err := selectRow(ctx, db, database, table, key, columns, rowFilters)
+			if r == nil {
 				return nil, err
 			}
-			if len(r) == 0 {
-				return nil, nil
-			} else {
-				return r[0], nil
+			if err := embedRows(ctx, db, database, table, []map[string]any{r}, embeds); err != nil {
+				return nil, err
 			}
+			return r, nil
 		}
 	case http.MethodPost:
-		qms, keys, values, err := gosqlcrud.MapForSqlInsert(params, database.dbType)
-		if err != nil {
-			return nil, err
+		if paramBool(params[".returning"], false) {
+			r, err := writeRowReturning(ctx, db, method, database, table, nil, params, access, rowFilters)
+			if r == nil {
+				return nil, err
+			}
+			return r, nil
 		}
-		return gosqlcrud.Exec(db, fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, table.Name, keys, qms), values...)
+		return insertRow(ctx, db, database, table, params, access, rowFilters)
 	case http.MethodPut:
-		setClause, values, err := gosqlcrud.MapForSqlUpdate(params, database.dbType)
-		if err != nil {
-			return nil, err
+		if key == nil {
+			return nil, badRequest("primary key %s is required", table.PrimaryKey)
 		}
-		placeholder := gosqlcrud.GetPlaceHolder(len(params), database.dbType)
-		values = append(values, dataId)
-		return gosqlcrud.Exec(db, fmt.Sprintf(`UPDATE %s SET %s WHERE %s=%s`, table.Name, setClause, table.PrimaryKey, placeholder), values...)
+		if paramBool(params[".returning"], false) {
+			r, err := writeRowReturning(ctx, db, method, database, table, key, params, access, rowFilters)
+			if r == nil {
+				return nil, err
+			}
+			return r, nil
+		}
+		return updateRow(ctx, db, database, table, key, params, access, rowFilters)
 	case http.MethodDelete:
-		placeholder := gosqlcrud.GetPlaceHolder(0, database.dbType)
-		return gosqlcrud.Exec(db, fmt.Sprintf(`DELETE FROM %s WHERE %s=%s`, table.Name, table.PrimaryKey, placeholder), dataId)
+		if key == nil {
+			return nil, badRequest("primary key %s is required", table.PrimaryKey)
+		}
+		return deleteRow(ctx, db, database, table, key, rowFilters)
 	}
 	return nil, fmt.Errorf("Method %s not supported.", method)
 }
 
-func runExec(database *Database, statements []*Statement, params map[string]any, r *http.Request) (any, error) {
-	db, err := database.GetConn()
+func insertRow(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, params map[string]any, access *Access, rowFilters map[string]any) (map[string]int64, error) {
+	q, values, err := insertStatement(database, table, params, access, rowFilters, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return database.exec(ctx, conn, table.Name+" insert", nil, q, values...)
+}
+
+// insertStatement builds the statement that inserts params. output and
+// returning are added to a plain insert to return the inserted record.
+func insertStatement(database *Database, table *Table, params map[string]any, access *Access, rowFilters map[string]any, output string, returning string) (string, []any, error) {
+	err := checkColumns(params, table.GetWritableColumns(access), "writable")
+	if err != nil {
+		return "", nil, err
+	}
+	upsert := paramBool(params[".upsert"], table.Upsert)
+	deleteDotParams(params)
+	forceRowFilters(params, rowFilters)
+	if upsert {
+		columns := sortedKeys(params)
+		q, err := database.upsertStatement(table, columns, 1, rowFilters)
+		if err != nil {
+			return "", nil, err
+		}
+		values := []any{}
+		for _, column := range columns {
+			values = append(values, params[column])
+		}
+		return q, values, nil
+	}
+	qms, keys, values, err := gosqlcrud.MapForSqlInsert(params, database.dbType)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf(`INSERT INTO %s (%s)%s VALUES (%s)%s`, table.Name, keys, output, qms, returning), values, nil
+}
+
+func updateRow(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, key []any, params map[string]any, access *Access, rowFilters map[string]any) (map[string]int64, error) {
+	q, values, err := updateStatement(database, table, key, params, access, rowFilters, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return database.exec(ctx, conn, table.Name+" update", nil, q, values...)
+}
+
+// updateStatement builds the statement that updates the record of key with
+// params. output and returning are added to return the updated record.
+func updateStatement(database *Database, table *Table, key []any, params map[string]any, access *Access, rowFilters map[string]any, output string, returning string) (string, []any, error) {
+	err := checkColumns(params, table.GetWritableColumns(access), "writable")
+	if err != nil {
+		return "", nil, err
+	}
+	deleteDotParams(params)
+	forceRowFilters(params, rowFilters)
+	setClause, values, err := gosqlcrud.MapForSqlUpdate(params, database.dbType)
+	if err != nil {
+		return "", nil, err
+	}
+	keyWhere := database.keyWhere(table, len(values))
+	values = append(values, key...)
+	rowWhere, rowValues, err := database.rowFilterWhere(rowFilters, len(values))
+	if err != nil {
+		return "", nil, err
+	}
+	values = append(values, rowValues...)
+	return fmt.Sprintf(`UPDATE %s SET %s%s WHERE %s %s%s`, table.Name, setClause, output, keyWhere, rowWhere, returning), values, nil
+}
+
+// selectRow returns the columns of the record of key, or nil if the record is
+// not found within the row filters. No columns means all columns.
+func selectRow(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, key []any, columns []string, rowFilters map[string]any) (map[string]any, error) {
+	columnList := "*"
+	if len(columns) > 0 {
+		columnList = strings.Join(columns, ", ")
+	}
+	gosqlcrud.SqlSafe(&columnList)
+	rowWhere, rowValues, err := database.rowFilterWhere(rowFilters, len(key))
+	if err != nil {
+		return nil, err
+	}
+	r, err := database.queryToMaps(ctx, conn, table.Name+" get", nil, fmt.Sprintf(`SELECT %s FROM %s WHERE %s %s`, columnList, table.Name, database.keyWhere(table, 0), rowWhere), append(slices.Clone(key), rowValues...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) == 0 {
+		return nil, nil
+	}
+	return r[0], nil
+}
+
+func deleteRow(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, key []any, rowFilters map[string]any) (map[string]int64, error) {
+	rowWhere, rowValues, err := database.rowFilterWhere(rowFilters, len(key))
+	if err != nil {
+		return nil, err
+	}
+	return database.exec(ctx, conn, table.Name+" delete", nil, fmt.Sprintf(`DELETE FROM %s WHERE %s %s`, table.Name, database.keyWhere(table, 0), rowWhere), append(slices.Clone(key), rowValues...)...)
+}
+
+func runExec(database *Database, statements []*Statement, params map[string]any, r *http.Request, stream *rowStreamer) (any, error) {
+	ctx := r.Context()
+	db, err := database.getConn(isQueryOnly(statements), params)
 	if err != nil {
 		return nil, err
 	}
 	exportedResults := map[string]any{}
+	if stream != nil {
+		// a single statement exported without a label is the whole response
+		exports := []*Statement{}
+		for _, statement := range statements {
+			if statement.SQL != "" && statement.Export {
+				exports = append(exports, statement)
+			}
+		}
+		stream.labeled = len(exports) != 1 || exports[0].Label != ""
+	}
 
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -776,6 +1684,8 @@ func runExec(database *Database, statements []*Statement, params map[string]any,
 		statementSQL := statement.SQL
 
 		ReplaceRequestParameters(&statementSQL, r)
+		requestParams, requestValues := requestParameters(statement.SQL, r)
+		statementCtx := withStatementTemplate(ctx, &statementTemplate{sql: statement.SQL, params: requestParams, values: requestValues})
 
 		var result any
 		sqlParams := []any{}
@@ -788,8 +1698,17 @@ func runExec(database *Database, statements []*Statement, params map[string]any,
 			}
 		}
 
-		if statement.Query {
-			result, err = gosqlcrud.QueryToMaps(tx, statementSQL, sqlParams...)
+		if statement.Query && statement.Export && stream != nil {
+			done := database.startStatement(statementCtx, statement.Label, statementSQL, statement.Params, sqlParams)
+			rows := stream.rows
+			err = stream.query(withContext(statementCtx, tx), statement.Label, statementSQL, sqlParams...)
+			done(int64(stream.rows-rows), err)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		} else if statement.Query {
+			result, err = database.queryToMaps(statementCtx, tx, statement.Label, statement.Params, statementSQL, sqlParams...)
 			if err != nil {
 				tx.Rollback()
 				return nil, err
@@ -798,13 +1717,19 @@ func runExec(database *Database, statements []*Statement, params map[string]any,
 				exportedResults[statement.Label] = result
 			}
 		} else {
-			result, err = gosqlcrud.Exec(tx, statementSQL, sqlParams...)
+			execResult, err := database.exec(statementCtx, tx, statement.Label, statement.Params, statementSQL, sqlParams...)
 			if err != nil {
 				tx.Rollback()
 				return nil, err
 			}
-			if statement.Export {
-				exportedResults[statement.Label] = result
+			if statement.Export && stream != nil {
+				err = stream.result(statement.Label, execResult)
+				if err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			} else if statement.Export {
+				exportedResults[statement.Label] = execResult
 			}
 		}
 
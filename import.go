@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMaxImportSize limits the body of an import when
+	// web.max_import_size is not set.
+	defaultMaxImportSize = 1024 * 1024 * 1024 // 1GB
+	// importBatchRows is the default number of rows inserted in a transaction.
+	importBatchRows = 1000
+	// maxImportErrors stops an import after as many rows have failed.
+	maxImportErrors = 100
+	// importBatchTimeout extends the read and write deadlines of an import at
+	// each batch, so that an import is not cut by the timeouts of the server
+	// while it is making progress.
+	importBatchTimeout = 30 * time.Second
+)
+
+// importFormat returns the format of an import body, csv or ndjson, or an
+// empty string if the body is not an import.
+func importFormat(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	if format := acceptFormats[mediaType]; format == formatCSV || format == formatNDJSON {
+		return format
+	}
+	return ""
+}
+
+// importError is the error of a row of an import, by its line in the body.
+type importError struct {
+	Line    int    `json:"line"`
+	Message string `json:"error"`
+}
+
+func (this *importError) Error() string {
+	return fmt.Sprintf("line %d: %s", this.Line, this.Message)
+}
+
+// importReader reads the rows of an import body one by one. A row that cannot
+// be parsed returns an *importError, and other errors end the import.
+type importReader interface {
+	next() (line int, row map[string]any, err error)
+}
+
+type csvImportReader struct {
+	reader    *csv.Reader
+	columns   []string
+	nullValue any
+}
+
+// newCSVImportReader reads the header row of r, whose columns must be in
+// tableColumns.
+func newCSVImportReader(r io.Reader, tableColumns []string, nullValue any) (*csvImportReader, error) {
+	reader := csv.NewReader(r)
+	columns, err := reader.Read()
+	if err == io.EOF {
+		return nil, badRequest("header row not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range columns {
+		if i == 0 {
+			// a byte order mark is left by some spreadsheet applications
+			column = strings.TrimPrefix(column, "\ufeff")
+			columns[i] = column
+		}
+		if !reColumnName.MatchString(column) || !columnAllowed(tableColumns, column) {
+			return nil, badRequest("column %s not found", column)
+		}
+	}
+	return &csvImportReader{reader: reader, columns: columns, nullValue: nullValue}, nil
+}
+
+func (this *csvImportReader) next() (int, map[string]any, error) {
+	record, err := this.reader.Read()
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		return parseError.StartLine, nil, &importError{Line: parseError.StartLine, Message: parseError.Err.Error()}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	line, _ := this.reader.FieldPos(0)
+	row := map[string]any{}
+	for i, column := range this.columns {
+		if record[i] == this.nullValue {
+			row[column] = nil
+		} else {
+			row[column] = record[i]
+		}
+	}
+	return line, row, nil
+}
+
+type ndjsonImportReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func (this *ndjsonImportReader) next() (int, map[string]any, error) {
+	for {
+		b, err := this.reader.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(b) == 0) {
+			return 0, nil, err
+		}
+		this.line++
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			continue
+		}
+		var row map[string]any
+		if err := json.Unmarshal(b, &row); err != nil || row == nil {
+			return this.line, nil, &importError{Line: this.line, Message: "row must be a JSON object"}
+		}
+		return this.line, row, nil
+	}
+}
+
+// importTable inserts the rows of a CSV or NDJSON body into table, and writes a
+// report of the import. The body is read as the rows are inserted, and is
+// limited by web.max_import_size instead of the size of other bodies.
+func (this *App) importTable(w http.ResponseWriter, r *http.Request, format string, database *Database, table *Table, access *Access) {
+	rowFilters, err := access.RowFilterValues(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	paramValues, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	params := valuesToMap(false, this.NullValue, paramValues)
+	batchSize := importBatchRows
+	if batchSizeParam, ok := params[".batch_size"]; ok {
+		batchSize, err = strconv.Atoi(fmt.Sprint(batchSizeParam))
+		if err != nil || batchSize <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid batch size %v", batchSizeParam))
+			return
+		}
+	}
+
+	ctx := r.Context()
+	timeout, err := this.requestTimeout(database, table.Timeout, params)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, this.Web.MaxImportSize)
+	defer r.Body.Close()
+	var reader importReader
+	if format == formatCSV {
+		tableColumns, err := database.TableColumns(table)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		csvReader, err := newCSVImportReader(r.Body, tableColumns, this.NullValue)
+		if err == nil {
+			header := map[string]any{}
+			for _, column := range csvReader.columns {
+				header[column] = nil
+			}
+			err = checkColumns(header, table.GetWritableColumns(access), "writable")
+		}
+		if err != nil {
+			writeJSONError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		reader = csvReader
+	} else {
+		reader = &ndjsonImportReader{reader: bufio.NewReader(r.Body)}
+	}
+
+	dryRun := paramBool(params[".dry_run"], false)
+	rc := http.NewResponseController(w)
+	extendDeadline := func() {
+		deadline := time.Now().Add(importBatchTimeout)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+	}
+	report, err := runImport(ctx, database, table, reader, batchSize, paramBool(params[".upsert"], table.Upsert), dryRun, access, rowFilters, extendDeadline)
+	setRows(w, report["rows_affected"].(int64))
+	status := http.StatusOK
+	if err != nil {
+		err = contextError(ctx, err, timeout)
+		status = errorStatus(err, http.StatusInternalServerError)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			status = http.StatusRequestEntityTooLarge
+			err = fmt.Errorf("import body is larger than %d bytes", maxBytesError.Limit)
+		}
+		if status >= 500 {
+			log.Printf("ERROR %d: %s\n", status, err.Error())
+		}
+		report["error"] = err.Error()
+	}
+	w.WriteHeader(status)
+	jsonData, _ := json.Marshal(report)
+	fmt.Fprintln(w, string(jsonData))
+}
+
+// runImport inserts the rows of reader in batches of batchSize rows, each in its
+// own transaction, which is rolled back on a dry run. A row that cannot be
+// parsed or inserted is reported and left out of its batch. The report counts
+// the rows inserted before an error that ends the import. extendDeadline is
+// called before each batch is read.
+func runImport(ctx context.Context, database *Database, table *Table, reader importReader, batchSize int, upsert bool, dryRun bool, access *Access, rowFilters map[string]any, extendDeadline func()) (map[string]any, error) {
+	var rows, rowsAffected int64
+	importErrors := []*importError{}
+	report := func() map[string]any {
+		return map[string]any{
+			"rows":          rows,
+			"rows_affected": rowsAffected,
+			"errors":        importErrors,
+			"dry_run":       dryRun,
+		}
+	}
+	addError := func(e *importError) error {
+		importErrors = append(importErrors, e)
+		if len(importErrors) >= maxImportErrors {
+			return badRequest("import stopped after %d failed rows", len(importErrors))
+		}
+		return nil
+	}
+
+	db, err := database.GetConn()
+	if err != nil {
+		return report(), err
+	}
+	batch := []any{}
+	lines := []int{}
+	insert := func() error {
+		for len(batch) > 0 {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			result, err := insertRows(ctx, tx, database, table, batch, upsert, access, rowFilters)
+			if err == nil {
+				if dryRun {
+					err = tx.Rollback()
+				} else {
+					err = tx.Commit()
+				}
+				if err != nil {
+					return err
+				}
+				rowsAffected += result["rows_affected"].(int64)
+				break
+			}
+			tx.Rollback()
+			var rowError *RowError
+			if !errors.As(err, &rowError) {
+				return err
+			}
+			if err := addError(&importError{Line: lines[rowError.Index], Message: rowError.Err.Error()}); err != nil {
+				return err
+			}
+			batch = slices.Delete(batch, rowError.Index, rowError.Index+1)
+			lines = slices.Delete(lines, rowError.Index, rowError.Index+1)
+		}
+		batch = batch[:0]
+		lines = lines[:0]
+		extendDeadline()
+		return nil
+	}
+
+	extendDeadline()
+	for {
+		line, row, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		var rowError *importError
+		if errors.As(err, &rowError) {
+			rows++
+			if err := addError(rowError); err != nil {
+				return report(), err
+			}
+			continue
+		}
+		if err != nil {
+			return report(), err
+		}
+		rows++
+		batch = append(batch, row)
+		lines = append(lines, line)
+		if len(batch) >= batchSize {
+			if err := insert(); err != nil {
+				return report(), err
+			}
+		}
+	}
+	if err := insert(); err != nil {
+		return report(), err
+	}
+	return report(), nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type jwtKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+func (this *App) buildJWT() error {
+	if this.JWT == nil {
+		return nil
+	}
+	this.JWT.Secret = resolveEnv(this.JWT.Secret)
+	if this.JWT.PublicKeyPath != "" {
+		pemBytes, err := os.ReadFile(this.JWT.PublicKeyPath)
+		if err != nil {
+			return err
+		}
+		keys, err := parsePEMPublicKeys(pemBytes)
+		if err != nil {
+			return err
+		}
+		this.JWT.publicKeys = append(this.JWT.publicKeys, keys...)
+	}
+	if this.JWT.JwksPath != "" {
+		jwksBytes, err := os.ReadFile(this.JWT.JwksPath)
+		if err != nil {
+			return err
+		}
+		keys, err := parseJWKS(jwksBytes)
+		if err != nil {
+			return err
+		}
+		this.JWT.publicKeys = append(this.JWT.publicKeys, keys...)
+	}
+	if this.JWT.Secret == "" && len(this.JWT.publicKeys) == 0 {
+		return fmt.Errorf("jwt requires a secret, public_key_path or jwks_path")
+	}
+
+	if this.JWT.TargetDatabase == "" {
+		this.JWT.TargetDatabase = "target_database"
+	}
+	if this.JWT.TargetObjects == "" {
+		this.JWT.TargetObjects = "target_objects"
+	}
+	if this.JWT.ReadPrivate == "" {
+		this.JWT.ReadPrivate = "read_private"
+	}
+	if this.JWT.WritePrivate == "" {
+		this.JWT.WritePrivate = "write_private"
+	}
+	if this.JWT.ExecPrivate == "" {
+		this.JWT.ExecPrivate = "exec_private"
+	}
+	if this.JWT.AllowedOrigins == "" {
+		this.JWT.AllowedOrigins = "allowed_origins"
+	}
+	if this.JWT.RowFilters == "" {
+		this.JWT.RowFilters = "row_filters"
+	}
+	if this.JWT.ReadableColumns == "" {
+		this.JWT.ReadableColumns = "readable_columns"
+	}
+	if this.JWT.WritableColumns == "" {
+		this.JWT.WritableColumns = "writable_columns"
+	}
+	return nil
+}
+
+func parsePEMPublicKeys(pemBytes []byte) ([]*jwtKey, error) {
+	keys := []*jwtKey{}
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &jwtKey{key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public key found")
+	}
+	return keys, nil
+}
+
+func parseJWKS(jwksBytes []byte) ([]*jwtKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err := json.Unmarshal(jwksBytes, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*jwtKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, &jwtKey{kid: jwk.Kid, key: &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}})
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err != nil {
+				return nil, err
+			}
+			point := make([]byte, 65)
+			point[0] = 4
+			copy(point[33-len(x):33], x)
+			copy(point[65-len(y):], y)
+			key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, &jwtKey{kid: jwk.Kid, key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing key found in jwks")
+	}
+	return keys, nil
+}
+
+// isJWT tells a JWT apart from static and managed tokens.
+func isJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature, expiry, not-before, issuer and audience of
+// token, and returns its claims.
+func (this *JWT) Verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	verified := false
+	switch header.Alg {
+	case "HS256":
+		if this.Secret == "" {
+			return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+		}
+		mac := hmac.New(sha256.New, []byte(this.Secret))
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		verified = hmac.Equal(signature, mac.Sum(nil))
+	case "RS256":
+		for _, key := range this.publicKeys {
+			rsaKey, ok := key.key.(*rsa.PublicKey)
+			if !ok || (header.Kid != "" && key.kid != "" && header.Kid != key.kid) {
+				continue
+			}
+			if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil {
+				verified = true
+				break
+			}
+		}
+	case "ES256":
+		if len(signature) != 64 {
+			return nil, fmt.Errorf("malformed token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		for _, key := range this.publicKeys {
+			ecKey, ok := key.key.(*ecdsa.PublicKey)
+			if !ok || ecKey.Curve != elliptic.P256() || (header.Kid != "" && key.kid != "" && header.Kid != key.kid) {
+				continue
+			}
+			if ecdsa.Verify(ecKey, digest[:], r, s) {
+				verified = true
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+	var claims map[string]any
+	err = json.Unmarshal(claimsBytes, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+
+	leeway := time.Duration(this.Leeway) * time.Second
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if this.Issuer != "" && claims["iss"] != this.Issuer {
+		return nil, fmt.Errorf("invalid issuer")
+	}
+	if this.Audience != "" && !slices.Contains(claimStrings(claims["aud"]), this.Audience) {
+		return nil, fmt.Errorf("invalid audience")
+	}
+	return claims, nil
+}
+
+// Access verifies token and maps its claims to an Access.
+func (this *JWT) Access(token string) (*Access, error) {
+	claims, err := this.Verify(token, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt, %v", err)
+	}
+	rowFilters, err := claimRowFilters(claims[this.RowFilters])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt, %v", err)
+	}
+	return &Access{
+		TargetDatabase:      claimString(claims[this.TargetDatabase]),
+		TargetObjectArray:   claimStrings(claims[this.TargetObjects]),
+		ReadPrivate:         claimBool(claims[this.ReadPrivate]),
+		WritePrivate:        claimBool(claims[this.WritePrivate]),
+		ExecPrivate:         claimBool(claims[this.ExecPrivate]),
+		AllowedOriginArray:  claimStrings(claims[this.AllowedOrigins]),
+		RowFilterMap:        rowFilters,
+		ReadableColumnArray: claimStrings(claims[this.ReadableColumns]),
+		WritableColumnArray: claimStrings(claims[this.WritableColumns]),
+		claims:              claims,
+	}, nil
+}
+
+// claimRowFilters accepts an object or whitespace separated COLUMN=value pairs.
+func claimRowFilters(claim any) (map[string]string, error) {
+	switch v := claim.(type) {
+	case string:
+		return parseRowFilters(v)
+	case map[string]any:
+		rowFilters := map[string]string{}
+		for column, value := range v {
+			rowFilters[column] = claimString(value)
+		}
+		return rowFilters, checkRowFilters(rowFilters)
+	}
+	return nil, nil
+}
+
+func claimString(claim any) string {
+	switch v := claim.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(claim)
+}
+
+// claimStrings accepts an array of strings or a whitespace separated string.
+func claimStrings(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		ret := []string{}
+		for _, item := range v {
+			ret = append(ret, claimString(item))
+		}
+		return ret
+	}
+	return nil
+}
+
+func claimBool(claim any) bool {
+	switch v := claim.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
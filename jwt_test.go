@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg string, key any, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]any{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerify(t *testing.T) {
+	now := time.Now()
+	jwt := &JWT{Secret: "secret", Issuer: "idp", Audience: "gosqlapi"}
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss": "idp",
+			"aud": []any{"other", "gosqlapi"},
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	testCases := map[string]struct {
+		token string
+		err   string
+	}{
+		"valid":          {signJWT(t, "HS256", []byte("secret"), claims(nil)), ""},
+		"bad signature":  {signJWT(t, "HS256", []byte("wrong"), claims(nil)), "invalid signature"},
+		"expired":        {signJWT(t, "HS256", []byte("secret"), claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), "token expired"},
+		"no expiry":      {signJWT(t, "HS256", []byte("secret"), claims(map[string]any{"exp": nil})), "token has no expiry"},
+		"not valid yet":  {signJWT(t, "HS256", []byte("secret"), claims(map[string]any{"nbf": now.Add(time.Minute).Unix()})), "token not valid yet"},
+		"wrong issuer":   {signJWT(t, "HS256", []byte("secret"), claims(map[string]any{"iss": "evil"})), "invalid issuer"},
+		"wrong audience": {signJWT(t, "HS256", []byte("secret"), claims(map[string]any{"aud": "other"})), "invalid audience"},
+		"alg none":       {signJWT(t, "none", nil, claims(nil)), "unsupported algorithm none"},
+		"malformed":      {"eyJ.abc", "malformed token"},
+	}
+	for name, testCase := range testCases {
+		_, err := jwt.Verify(testCase.token, now)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != testCase.err {
+			t.Errorf(`%s; wanted "%s", got "%s"`, name, testCase.err, got)
+		}
+	}
+
+	jwt.RowFilters = "row_filters"
+	for _, rowFilters := range []any{"TENANT_ID=1 ID)OR(1=1", map[string]any{"1=1 OR ID": "1"}} {
+		if _, err := jwt.Access(signJWT(t, "HS256", []byte("secret"), claims(map[string]any{"row_filters": rowFilters}))); err == nil {
+			t.Errorf("row filters %v; wanted error, got nil", rowFilters)
+		}
+	}
+}
+
+func TestJWTPublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPoint, err := ecKey.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "n": "%s", "e": "%s"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "%s", "y": "%s"}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecPoint[1:33]),
+		base64.RawURLEncoding.EncodeToString(ecPoint[33:]))
+	jwksKeys, err := parseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKeys, err := parsePEMPublicKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{
+		"exp":             time.Now().Add(time.Hour).Unix(),
+		"target_database": "test_db",
+		"target_objects":  "test_table token_table",
+		"read_private":    true,
+		"write_private":   1,
+		"allowed_origins": []any{"*"},
+	}
+	for name, jwt := range map[string]*JWT{
+		"jwks": {publicKeys: jwksKeys},
+		"pem":  {publicKeys: pemKeys},
+	} {
+		app := &App{JWT: jwt}
+		if err := app.buildJWT(); err != nil {
+			t.Fatal(err)
+		}
+		for alg, key := range map[string]any{"RS256": rsaKey, "ES256": ecKey} {
+			access, err := jwt.Access(signJWT(t, alg, key, claims))
+			if name == "pem" && alg == "RS256" {
+				if err == nil {
+					t.Errorf("%s %s; wanted error, got nil", name, alg)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s %s; %v", name, alg, err)
+				continue
+			}
+			if access.TargetDatabase != "test_db" || len(access.TargetObjectArray) != 2 ||
+				!access.ReadPrivate || !access.WritePrivate || access.ExecPrivate ||
+				len(access.AllowedOriginArray) != 1 {
+				t.Errorf("%s %s; unexpected access %+v", name, alg, access)
+			}
+		}
+		if _, err := jwt.Access(signJWT(t, "HS256", []byte(""), claims)); err == nil {
+			t.Errorf("%s; HS256 accepted without a secret", name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+// Columns is a list of columns, which can also be configured as a comma
+// separated string.
+type Columns []string
+
+func (this *Columns) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*this = nil
+		for column := range strings.SplitSeq(s, ",") {
+			if column = strings.TrimSpace(column); column != "" {
+				*this = append(*this, column)
+			}
+		}
+		return nil
+	}
+	var columns []string
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return fmt.Errorf("columns must be a string or an array of strings")
+	}
+	*this = columns
+	return nil
+}
+
+func (this Columns) String() string {
+	return strings.Join(this, ", ")
+}
+
+// ParseKey returns the primary key values addressed by the path segment key,
+// in the order of the primary key columns. key is either the values separated
+// by commas, or matrix-style COLUMN=value pairs separated by semicolons. A
+// single column primary key takes the whole segment as its value.
+func (this *Table) ParseKey(key string) ([]any, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if values, ok := this.parseMatrixKey(key); ok {
+		return values, nil
+	}
+	if len(this.PrimaryKey) == 1 {
+		gosqlcrud.SqlSafe(&key)
+		return []any{key}, nil
+	}
+	parts := strings.Split(key, ",")
+	if len(parts) != len(this.PrimaryKey) {
+		return nil, badRequest("key must have %d values for primary key %s", len(this.PrimaryKey), this.PrimaryKey)
+	}
+	values := []any{}
+	for _, part := range parts {
+		gosqlcrud.SqlSafe(&part)
+		values = append(values, part)
+	}
+	return values, nil
+}
+
+func (this *Table) parseMatrixKey(key string) ([]any, bool) {
+	pairs := map[string]any{}
+	for part := range strings.SplitSeq(strings.TrimPrefix(key, ";"), ";") {
+		column, value, ok := strings.Cut(part, "=")
+		if !ok || !columnAllowed(this.PrimaryKey, column) {
+			return nil, false
+		}
+		gosqlcrud.SqlSafe(&value)
+		pairs[column] = value
+	}
+	return this.KeyFromMap(pairs)
+}
+
+// KeyFromMap returns the primary key values found in m, and whether all primary
+// key columns are in m.
+func (this *Table) KeyFromMap(m map[string]any) ([]any, bool) {
+	values := []any{}
+	for _, column := range this.PrimaryKey {
+		value, ok := rowValue(m, column)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
+// KeyFromQuery takes the primary key values out of the query parameters, when
+// all primary key columns are there.
+func (this *Table) KeyFromQuery(query url.Values, params map[string]any) []any {
+	queryParams := map[string]any{}
+	for k := range query {
+		queryParams[k] = params[k]
+	}
+	values, ok := this.KeyFromMap(queryParams)
+	if !ok {
+		return nil
+	}
+	for k := range query {
+		if columnAllowed(this.PrimaryKey, k) {
+			delete(params, k)
+		}
+	}
+	return values
+}
+
+// keyWhere builds the WHERE conditions of the primary key. Placeholders are
+// numbered from startIndex.
+func (this *Database) keyWhere(table *Table, startIndex int) string {
+	conditions := []string{}
+	for i, column := range table.PrimaryKey {
+		conditions = append(conditions, fmt.Sprintf("%s=%s", column, gosqlcrud.GetPlaceHolder(startIndex+i, this.dbType)))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// keyValue returns the key of a record as the value of a single column primary
+// key, or the values of a composite primary key.
+func keyValue(values []any) any {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 func init() {
@@ -16,6 +18,7 @@ const version = "48"
 func main() {
 	v := flag.Bool("v", false, "prints version")
 	confPath := flag.String("c", "gosqlapi.json", "configuration file path")
+	openAPI := flag.Bool("openapi", false, "prints the OpenAPI document")
 	flag.Parse()
 	if *v {
 		fmt.Println(version)
@@ -29,10 +32,24 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *openAPI {
+		jsonData, err := json.MarshalIndent(app.OpenAPI(), "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(jsonData))
+		os.Exit(0)
+	}
 	app.run()
 
+	go WatchFile(*confPath, time.Second, func() {
+		app.reloadFile(*confPath)
+	})
+
 	Hook(func() {
 		app.shutdown()
+	}, func() {
+		app.reloadFile(*confPath)
 	})
 }
 
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the buckets of the request
+// latency histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Reasons of authorization failures.
+const (
+	authObjectNotFound = "object_not_found"
+	authInvalidJWT     = "invalid_jwt"
+	authTokenLookup    = "token_lookup"
+	authTokenNotFound  = "token_not_found"
+	authNotAllowed     = "not_allowed"
+)
+
+type requestLabels struct {
+	db     string
+	object string
+	method string
+	status string
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// metrics collects the metrics of the server. They outlive reloads, so that
+// counters are not reset when the configuration changes.
+type metrics struct {
+	mu               sync.Mutex
+	requests         map[requestLabels]*histogram
+	authFailures     map[string]uint64
+	tokenCacheHits   atomic.Uint64
+	tokenCacheMisses atomic.Uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:     map[requestLabels]*histogram{},
+		authFailures: map[string]uint64{},
+	}
+}
+
+func (this *metrics) observeRequest(labels requestLabels, duration time.Duration) {
+	if this == nil {
+		return
+	}
+	seconds := duration.Seconds()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	h := this.requests[labels]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		this.requests[labels] = h
+	}
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (this *metrics) authFailure(reason string) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.authFailures[reason]++
+}
+
+// tokenCacheLookup counts a lookup of the managed token cache.
+func (this *metrics) tokenCacheLookup(hit bool) {
+	if this == nil {
+		return
+	}
+	if hit {
+		this.tokenCacheHits.Add(1)
+	} else {
+		this.tokenCacheMisses.Add(1)
+	}
+}
+
+// authFailed counts an authorization failure under reason, and returns err.
+func (this *App) authFailed(reason string, err error) (*Access, error) {
+	this.metrics.authFailure(reason)
+	return nil, err
+}
+
+// countRequest counts the request r, answered by recorder in duration.
+// Unknown databases and objects are counted with empty labels, so that
+// arbitrary paths do not add series.
+func (this *App) countRequest(recorder *responseRecorder, r *http.Request, duration time.Duration) {
+	labels := requestLabels{method: r.Method, status: strconv.Itoa(recorder.statusCode())}
+	if this.Databases[r.PathValue("db")] != nil {
+		labels.db = r.PathValue("db")
+	}
+	if objectId := r.PathValue("obj"); this.Tables[objectId] != nil || this.Scripts[objectId] != nil {
+		labels.object = objectId
+	}
+	switch labels.method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		labels.method = "OTHER"
+	}
+	this.metrics.observeRequest(labels, duration)
+}
+
+func (this *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !this.Web.Metrics {
+		this.setHeaders(w)
+		writeJSONError(w, http.StatusNotFound, "metrics is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	this.writeMetrics(w)
+}
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func (this *App) writeMetrics(w io.Writer) {
+	var b strings.Builder
+	m := this.metrics
+
+	m.mu.Lock()
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	slices.SortFunc(requests, func(a, b requestLabels) int {
+		return strings.Compare(a.db+"\x00"+a.object+"\x00"+a.method+"\x00"+a.status, b.db+"\x00"+b.object+"\x00"+b.method+"\x00"+b.status)
+	})
+	writeMetricHeader(&b, "gosqlapi_requests_total", "counter", "Requests served, by database, object, method and status.")
+	for _, labels := range requests {
+		fmt.Fprintf(&b, "gosqlapi_requests_total{%s} %d\n", labels.String(), m.requests[labels].count)
+	}
+	writeMetricHeader(&b, "gosqlapi_request_duration_seconds", "histogram", "Latency of requests, by database, object, method and status.")
+	for _, labels := range requests {
+		h := m.requests[labels]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(&b, "gosqlapi_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels.String(), strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(&b, "gosqlapi_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels.String(), h.count)
+		fmt.Fprintf(&b, "gosqlapi_request_duration_seconds_sum{%s} %s\n", labels.String(), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "gosqlapi_request_duration_seconds_count{%s} %d\n", labels.String(), h.count)
+	}
+	writeMetricHeader(&b, "gosqlapi_auth_failures_total", "counter", "Authorization failures, by reason.")
+	for _, reason := range sortedKeys(m.authFailures) {
+		fmt.Fprintf(&b, "gosqlapi_auth_failures_total{reason=\"%s\"} %d\n", labelValue(reason), m.authFailures[reason])
+	}
+	m.mu.Unlock()
+
+	writeMetricHeader(&b, "gosqlapi_token_cache_hits_total", "counter", "Managed tokens found in the token cache.")
+	fmt.Fprintf(&b, "gosqlapi_token_cache_hits_total %d\n", m.tokenCacheHits.Load())
+	writeMetricHeader(&b, "gosqlapi_token_cache_misses_total", "counter", "Managed tokens looked up in the database.")
+	fmt.Fprintf(&b, "gosqlapi_token_cache_misses_total %d\n", m.tokenCacheMisses.Load())
+
+	// databases whose connection pool is not open yet are left out
+	stats := map[string]sql.DBStats{}
+	for databaseId, database := range this.Databases {
+		database.mu.Lock()
+		conn := database.conn
+		database.mu.Unlock()
+		if conn != nil {
+			stats[databaseId] = conn.Stats()
+		}
+	}
+	for _, metric := range []struct {
+		name  string
+		kind  string
+		help  string
+		value func(sql.DBStats) int64
+	}{
+		{"gosqlapi_db_open_connections", "gauge", "Open connections to the database.", func(s sql.DBStats) int64 { return int64(s.OpenConnections) }},
+		{"gosqlapi_db_in_use_connections", "gauge", "Connections to the database in use.", func(s sql.DBStats) int64 { return int64(s.InUse) }},
+		{"gosqlapi_db_idle_connections", "gauge", "Idle connections to the database.", func(s sql.DBStats) int64 { return int64(s.Idle) }},
+		{"gosqlapi_db_wait_count_total", "counter", "Connections to the database waited for.", func(s sql.DBStats) int64 { return s.WaitCount }},
+	} {
+		writeMetricHeader(&b, metric.name, metric.kind, metric.help)
+		for _, databaseId := range sortedKeys(stats) {
+			fmt.Fprintf(&b, "%s{db=\"%s\"} %d\n", metric.name, labelValue(databaseId), metric.value(stats[databaseId]))
+		}
+	}
+
+	writeMetricHeader(&b, "gosqlapi_db_replica_healthy", "gauge", "Whether the replica of the database serves reads.")
+	for _, databaseId := range sortedKeys(this.Databases) {
+		database := this.Databases[databaseId]
+		database.mu.Lock()
+		replicas := database.replicas
+		database.mu.Unlock()
+		if replicas == nil {
+			continue
+		}
+		for i, r := range replicas.replicas {
+			healthy := 0
+			if r.healthy.Load() {
+				healthy = 1
+			}
+			fmt.Fprintf(&b, "gosqlapi_db_replica_healthy{db=\"%s\",replica=\"%d\"} %d\n", labelValue(databaseId), i, healthy)
+		}
+	}
+	io.WriteString(w, b.String())
+}
+
+func writeMetricHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (this requestLabels) String() string {
+	return fmt.Sprintf(`db="%s",object="%s",method="%s",status="%s"`, labelValue(this.db), labelValue(this.object), this.method, this.status)
+}
+
+// labelValue escapes s as the value of a label.
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
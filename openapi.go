@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+func (this *App) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	this.setCorsHeaders(w, r)
+	this.setHeaders(w)
+
+	if !this.Web.OpenAPI {
+		writeJSONError(w, http.StatusNotFound, "openapi is not enabled")
+		return
+	}
+
+	doc := this.OpenAPI()
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	doc["servers"] = []any{map[string]any{"url": fmt.Sprintf("%s://%s", scheme, r.Host)}}
+
+	jsonData, err := json.Marshal(doc)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	fmt.Fprintln(w, string(jsonData))
+}
+
+// OpenAPI returns an OpenAPI 3 document describing all tables and scripts.
+// Column types are introspected from the databases; tables that cannot be
+// introspected are described with a generic object schema.
+func (this *App) OpenAPI() map[string]any {
+	paths := map[string]any{}
+
+	for _, tableId := range sortedKeys(this.Tables) {
+		table := this.Tables[tableId]
+		for _, databaseId := range this.objectDatabases(table.Database) {
+			database, err := this.GetDatabase(databaseId)
+			if err != nil {
+				log.Printf("openapi: %v\n", err)
+				continue
+			}
+			this.tableOpenAPIPaths(paths, databaseId, database, tableId, table)
+		}
+	}
+
+	for _, scriptId := range sortedKeys(this.Scripts) {
+		script := this.Scripts[scriptId]
+		for _, databaseId := range this.objectDatabases(script.Database) {
+			database, err := this.GetDatabase(databaseId)
+			if err != nil {
+				log.Printf("openapi: %v\n", err)
+				continue
+			}
+			this.scriptOpenAPIPaths(paths, databaseId, database, scriptId, script)
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "gosqlapi",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A static token from tokens, a managed token or a JWT. The Bearer prefix is optional.",
+				},
+			},
+			"schemas": map[string]any{
+				"ExecResult": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"rows_affected":  map[string]any{"type": "integer"},
+						"last_insert_id": map[string]any{"type": "integer"},
+					},
+				},
+				"Error": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"error": map[string]any{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// objectDatabases returns the databases a table or script is exposed on. An
+// object without a database is shared across all databases.
+func (this *App) objectDatabases(databaseId string) []string {
+	if databaseId != "" {
+		return []string{databaseId}
+	}
+	return sortedKeys(this.Databases)
+}
+
+func (this *App) tableOpenAPIPaths(paths map[string]any, databaseId string, database *Database, tableId string, table *Table) {
+	readableColumns := table.GetReadableColumns(nil)
+	columns := "*"
+	if len(readableColumns) > 0 {
+		columns = strings.Join(readableColumns, ", ")
+	}
+	record, err := database.querySchema(fmt.Sprintf(`SELECT %s FROM %s WHERE 1=0`, columns, table.Name))
+	if err != nil {
+		log.Printf("openapi: failed to introspect table %s, %v\n", tableId, err)
+		record = map[string]any{"type": "object"}
+	}
+	listRecord := record
+	if len(table.ExportedColumns) > 0 {
+		listColumns, err := table.ListColumns(readableColumns)
+		if err == nil {
+			listRecord, err = database.querySchema(fmt.Sprintf(`SELECT %s FROM %s WHERE 1=0`, strings.Join(listColumns, ", "), table.Name))
+		}
+		if err != nil {
+			log.Printf("openapi: failed to introspect table %s, %v\n", tableId, err)
+			listRecord = map[string]any{"type": "object"}
+		}
+	}
+	writableRecord := record
+	if properties, ok := record["properties"].(map[string]any); ok && len(table.WritableColumns) > 0 {
+		writableProperties := map[string]any{}
+		for column, schema := range properties {
+			if columnAllowed(table.WritableColumns, column) {
+				writableProperties[column] = schema
+			}
+		}
+		writableRecord = map[string]any{"type": "object", "properties": writableProperties}
+	}
+
+	selectParam := openAPIParam(".select", "query", false, "Columns to return separated by commas, each optionally renamed as alias:column.", map[string]any{"type": "string"})
+	readParams := []any{selectParam, openAPIFormatParam(), openAPITimeoutParam()}
+	if len(database.Replicas) > 0 {
+		readParams = append(readParams, openAPIPrimaryParam())
+	}
+	if len(table.Relations) > 0 {
+		readParams = append(readParams, openAPIParam(".embed", "query", false, fmt.Sprintf("Relations to embed separated by commas, of %s.", strings.Join(sortedKeys(table.Relations), ", ")), map[string]any{"type": "string"}))
+	}
+	listParams := []any{}
+	if properties, ok := record["properties"].(map[string]any); ok {
+		for _, column := range sortedKeys(properties) {
+			listParams = append(listParams, openAPIParam(column, "query", false, "Filter by column value. Use column.eq, .ne, .gt, .gte, .lt, .lte, .like, .ilike, .in, .nin or .is for other operators.", properties[column]))
+		}
+	}
+	listParams = append(listParams,
+		openAPIParam(".page_size", "query", false, "Maximum number of records returned.", map[string]any{"type": "integer"}),
+		openAPIParam(".offset", "query", false, "Number of records to skip.", map[string]any{"type": "integer"}),
+		openAPIParam(".order_by", "query", false, "Order of the records returned.", map[string]any{"type": "string"}),
+		openAPIParam(".show_total", "query", false, "Return the total number of records along with the page.", map[string]any{"type": "boolean"}),
+		openAPIParam(".cursor", "query", false, "Cursor of the page to return, empty for the first page.", map[string]any{"type": "string"}),
+		openAPIParam(".group_by", "query", false, "Columns to group the records by separated by commas.", map[string]any{"type": "string"}),
+		openAPIParam(".aggregate", "query", false, "Aggregates separated by commas, such as count(*) or sum(column), each optionally renamed as alias:sum(column). Allowed functions are count, sum, avg, min and max.", map[string]any{"type": "string"}),
+		openAPIStreamParam(),
+	)
+	listParams = append(listParams, readParams...)
+
+	keyDescription := fmt.Sprintf("Value of the primary key %s.", table.PrimaryKey)
+	if len(table.PrimaryKey) > 1 {
+		keyDescription = fmt.Sprintf("Values of the primary key %s separated by commas, or COLUMN=value pairs separated by semicolons.", table.PrimaryKey)
+	}
+	keyParam := openAPIParam("key", "path", true, keyDescription, map[string]any{"type": "string"})
+	body := map[string]any{
+		"required": true,
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": writableRecord},
+		},
+	}
+	postBody := map[string]any{
+		"required": true,
+		"content": map[string]any{
+			"application/json":     map[string]any{"schema": writableRecord},
+			"text/csv":             map[string]any{"schema": map[string]any{"type": "string"}},
+			"application/x-ndjson": map[string]any{"schema": map[string]any{"type": "string"}},
+		},
+	}
+	importParams := []any{
+		openAPIParam(".dry_run", "query", false, "Import CSV or NDJSON without keeping the rows.", map[string]any{"type": "boolean"}),
+		openAPIParam(".batch_size", "query", false, "Number of rows of CSV or NDJSON imported in a transaction.", map[string]any{"type": "integer"}),
+		openAPITimeoutParam(),
+	}
+	execResult := openAPIResponse("Statement result.", map[string]any{"$ref": "#/components/schemas/ExecResult"})
+
+	tag := fmt.Sprintf("%s/%s", databaseId, tableId)
+	read := this.openAPISecurity(table.PublicRead)
+	write := this.openAPISecurity(table.PublicWrite)
+
+	paths[fmt.Sprintf("/%s/%s", databaseId, tableId)] = map[string]any{
+		"get": openAPIOperation(tag, fmt.Sprintf("List records of %s.", tableId), listParams, nil, read, openAPIResponse("Records.", map[string]any{
+			"oneOf": []any{
+				map[string]any{"type": "array", "items": listRecord},
+				map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"total":     map[string]any{"type": "integer"},
+						"page_size": map[string]any{"type": "integer"},
+						"offset":    map[string]any{"type": "integer"},
+						"data":      map[string]any{"type": "array", "items": listRecord},
+					},
+				},
+			},
+		})),
+		"post": openAPIOperation(tag, fmt.Sprintf("Create a record in %s.", tableId), importParams, postBody, write, execResult),
+	}
+	paths[fmt.Sprintf("/%s/%s/{key}", databaseId, tableId)] = map[string]any{
+		"get":    openAPIOperation(tag, fmt.Sprintf("Get a record of %s.", tableId), append([]any{keyParam}, readParams...), nil, read, openAPIResponse("Record.", record)),
+		"put":    openAPIOperation(tag, fmt.Sprintf("Update a record of %s.", tableId), []any{keyParam, openAPITimeoutParam()}, body, write, execResult),
+		"delete": openAPIOperation(tag, fmt.Sprintf("Delete a record of %s.", tableId), []any{keyParam, openAPITimeoutParam()}, nil, write, execResult),
+	}
+}
+
+func (this *App) scriptOpenAPIPaths(paths map[string]any, databaseId string, database *Database, scriptId string, script *Script) {
+	if script.Path == "" && script.SQL == "" {
+		return
+	}
+	statements, err := database.GetStatements(script)
+	if err != nil {
+		log.Printf("openapi: failed to build script %s, %v\n", scriptId, err)
+		return
+	}
+
+	names := []string{}
+	exports := map[string]any{}
+	for _, statement := range statements {
+		for _, param := range statement.Params {
+			if !slices.Contains(names, param) {
+				names = append(names, param)
+			}
+		}
+		if statement.Export {
+			if statement.Query {
+				exports[statement.Label] = map[string]any{"type": "array", "items": map[string]any{"type": "object"}}
+			} else {
+				exports[statement.Label] = map[string]any{"$ref": "#/components/schemas/ExecResult"}
+			}
+		}
+	}
+
+	var result map[string]any
+	if exported, ok := exports[""]; ok && len(exports) == 1 {
+		result = exported.(map[string]any)
+	} else {
+		result = map[string]any{"type": "object", "properties": exports}
+	}
+
+	queryParams := []any{}
+	bodyProperties := map[string]any{}
+	for _, name := range names {
+		queryParams = append(queryParams, openAPIParam(name, "query", true, "", map[string]any{}))
+		bodyProperties[name] = map[string]any{}
+	}
+	queryParams = append(queryParams, openAPIFormatParam(), openAPIStreamParam(), openAPITimeoutParam())
+	if len(database.Replicas) > 0 && isQueryOnly(statements) {
+		queryParams = append(queryParams, openAPIPrimaryParam())
+	}
+	var body map[string]any
+	if len(names) > 0 {
+		body = map[string]any{
+			"content": map[string]any{
+				"application/json": map[string]any{
+					"schema": map[string]any{
+						"type":       "object",
+						"properties": bodyProperties,
+						"required":   names,
+					},
+				},
+			},
+		}
+	}
+
+	tag := fmt.Sprintf("%s/%s", databaseId, scriptId)
+	security := this.openAPISecurity(script.PublicExec)
+	summary := fmt.Sprintf("Execute script %s.", scriptId)
+	operations := map[string]any{
+		"patch": openAPIOperation(tag, summary, nil, body, security, openAPIResponse("Exported results.", result)),
+	}
+	if this.Tables[scriptId] == nil {
+		operations["get"] = openAPIOperation(tag, summary, queryParams, nil, security, openAPIResponse("Exported results.", result))
+	}
+	paths[fmt.Sprintf("/%s/%s", databaseId, scriptId)] = operations
+}
+
+func (this *App) openAPISecurity(public bool) []any {
+	if public {
+		return []any{}
+	}
+	return []any{map[string]any{"bearerAuth": []any{}}}
+}
+
+func openAPIOperation(tag string, summary string, params []any, body map[string]any, security []any, ok map[string]any) map[string]any {
+	operation := map[string]any{
+		"tags":     []any{tag},
+		"summary":  summary,
+		"security": security,
+		"responses": map[string]any{
+			"200": ok,
+			"400": openAPIResponse("Bad request.", map[string]any{"$ref": "#/components/schemas/Error"}),
+			"401": openAPIResponse("Access denied.", map[string]any{"$ref": "#/components/schemas/Error"}),
+			"404": openAPIResponse("Not found.", map[string]any{"$ref": "#/components/schemas/Error"}),
+			"500": openAPIResponse("Server error.", map[string]any{"$ref": "#/components/schemas/Error"}),
+		},
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+	if body != nil {
+		operation["requestBody"] = body
+	}
+	return operation
+}
+
+func openAPIParam(name string, in string, required bool, description string, schema any) map[string]any {
+	param := map[string]any{
+		"name":     name,
+		"in":       in,
+		"required": required,
+		"schema":   schema,
+	}
+	if description != "" {
+		param["description"] = description
+	}
+	return param
+}
+
+// openAPIFormatParam returns the .format parameter, which overrides the Accept
+// header.
+func openAPIFormatParam() map[string]any {
+	return openAPIParam(".format", "query", false, "Format of the response, overriding the Accept header.", map[string]any{"type": "string", "enum": []any{formatJSON, formatCSV, formatNDJSON, formatXLSX}})
+}
+
+// openAPIStreamParam returns the .stream parameter.
+func openAPIStreamParam() map[string]any {
+	return openAPIParam(".stream", "query", false, "Stream the records as they are read, up to the row cap of the server.", map[string]any{"type": "boolean"})
+}
+
+// openAPITimeoutParam returns the .timeout parameter.
+func openAPITimeoutParam() map[string]any {
+	return openAPIParam(".timeout", "query", false, "Timeout of the request in seconds, up to the maximum timeout of the server.", map[string]any{"type": "number"})
+}
+
+// openAPIPrimaryParam returns the .primary parameter.
+func openAPIPrimaryParam() map[string]any {
+	return openAPIParam(".primary", "query", false, "Read from the primary instead of a replica.", map[string]any{"type": "boolean"})
+}
+
+func openAPIResponse(description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": schema},
+		},
+	}
+}
+
+// querySchema returns a JSON schema for the rows returned by query, which
+// should not return any rows.
+func (this *Database) querySchema(query string) (map[string]any, error) {
+	db, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	properties := map[string]any{}
+	for _, columnType := range columnTypes {
+		schema := map[string]any{}
+		typeName := strings.ToUpper(columnType.DatabaseTypeName())
+		switch {
+		case strings.Contains(typeName, "BOOL") || typeName == "BIT":
+			schema["type"] = "boolean"
+		case strings.Contains(typeName, "INT") || typeName == "SERIAL" || typeName == "BIGSERIAL":
+			schema["type"] = "integer"
+		case strings.Contains(typeName, "REAL") || strings.Contains(typeName, "FLOAT") ||
+			strings.Contains(typeName, "DOUBLE") || strings.Contains(typeName, "NUMERIC") ||
+			strings.Contains(typeName, "DECIMAL") || strings.Contains(typeName, "NUMBER") ||
+			strings.Contains(typeName, "MONEY"):
+			schema["type"] = "number"
+		case strings.Contains(typeName, "TIMESTAMP") || strings.Contains(typeName, "DATETIME"):
+			schema["type"] = "string"
+			schema["format"] = "date-time"
+		case strings.Contains(typeName, "DATE"):
+			schema["type"] = "string"
+			schema["format"] = "date"
+		case typeName == "":
+			if scanType := columnType.ScanType(); scanType != nil {
+				switch scanType.Kind() {
+				case reflect.Bool:
+					schema["type"] = "boolean"
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+					reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+					schema["type"] = "integer"
+				case reflect.Float32, reflect.Float64:
+					schema["type"] = "number"
+				case reflect.String:
+					schema["type"] = "string"
+				default:
+					if scanType == reflect.TypeFor[time.Time]() {
+						schema["type"] = "string"
+						schema["format"] = "date-time"
+					}
+				}
+			}
+		default:
+			schema["type"] = "string"
+		}
+		if nullable, ok := columnType.Nullable(); ok && nullable {
+			schema["nullable"] = true
+		}
+		properties[strings.ToLower(columnType.Name())] = schema
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+type orderColumn struct {
+	Column  string
+	Desc    bool
+	Nulls   string // FIRST, LAST or empty for the database default
+	NotNull bool   // a primary key column, which is never NULL
+}
+
+// parseOrderBy parses comma separated columns. A column is descending with a -
+// prefix, and can be followed by ASC or DESC and NULLS FIRST or NULLS LAST, or
+// by the same modifiers as .asc, .desc, .nullsfirst and .nullslast suffixes.
+func parseOrderBy(orderBy string) ([]*orderColumn, error) {
+	order := []*orderColumn{}
+	for item := range strings.SplitSeq(orderBy, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		column := &orderColumn{}
+		s := item
+		if strings.HasPrefix(s, "-") {
+			column.Desc = true
+			s = s[1:]
+		} else {
+			s = strings.TrimPrefix(s, "+")
+		}
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			return nil, badRequest("invalid order by %s", item)
+		}
+		name, suffix, _ := strings.Cut(fields[0], ".")
+		modifiers := fields[1:]
+		if suffix != "" {
+			modifiers = append(strings.Split(suffix, "."), modifiers...)
+		}
+		if !reColumnName.MatchString(name) {
+			return nil, badRequest("invalid order by %s", item)
+		}
+		column.Column = name
+		for i := 0; i < len(modifiers); i++ {
+			switch strings.ToUpper(modifiers[i]) {
+			case "ASC":
+				column.Desc = false
+			case "DESC":
+				column.Desc = true
+			case "NULLSFIRST":
+				column.Nulls = "FIRST"
+			case "NULLSLAST":
+				column.Nulls = "LAST"
+			case "NULLS":
+				if i+1 < len(modifiers) && (strings.EqualFold(modifiers[i+1], "FIRST") || strings.EqualFold(modifiers[i+1], "LAST")) {
+					column.Nulls = strings.ToUpper(modifiers[i+1])
+					i++
+					continue
+				}
+				return nil, badRequest("invalid order by %s", item)
+			default:
+				return nil, badRequest("invalid order by %s", item)
+			}
+		}
+		order = append(order, column)
+	}
+	return order, nil
+}
+
+// checkOrder rejects the order columns that are not columns of the table, or
+// not readable. Without exported columns, the columns are checked against the
+// columns in the database.
+func (this *Database) checkOrder(table *Table, order []*orderColumn, readableColumns []string) error {
+	columns := []string(table.ExportedColumns)
+	if len(columns) == 0 {
+		var err error
+		columns, err = this.TableColumns(table)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range order {
+		if !columnAllowed(columns, c.Column) || !columnAllowed(readableColumns, c.Column) {
+			return badRequest("invalid order by column %s", c.Column)
+		}
+	}
+	return nil
+}
+
+// TableColumns returns the columns of the table in the database. The columns
+// are cached until the configuration is reloaded.
+func (this *Database) TableColumns(table *Table) ([]string, error) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if table.columns != nil {
+		return table.columns, nil
+	}
+	conn, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(fmt.Sprintf(`SELECT * FROM %s WHERE 1=0`, table.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	table.columns = columns
+	return columns, nil
+}
+
+// keysetOrder appends the primary key columns that are not in order, so that
+// every row has a unique position.
+func (this *Table) keysetOrder(order []*orderColumn) []*orderColumn {
+	keysetOrder := []*orderColumn{}
+	for _, c := range order {
+		c := *c
+		c.NotNull = slices.ContainsFunc(this.PrimaryKey, func(column string) bool {
+			return strings.EqualFold(c.Column, column)
+		})
+		keysetOrder = append(keysetOrder, &c)
+	}
+	for _, column := range this.PrimaryKey {
+		found := slices.ContainsFunc(order, func(c *orderColumn) bool {
+			return strings.EqualFold(c.Column, column)
+		})
+		if !found {
+			keysetOrder = append(keysetOrder, &orderColumn{Column: column, NotNull: true})
+		}
+	}
+	return keysetOrder
+}
+
+// nullsFirst reports whether the NULLs of c are sorted before the other values.
+// By default, NULLs are the largest values on PostgreSQL and Oracle, and the
+// smallest on the other databases.
+func (this *Database) nullsFirst(c *orderColumn) bool {
+	switch c.Nulls {
+	case "FIRST":
+		return true
+	case "LAST":
+		return false
+	}
+	nullsLargest := this.dbType == gosqlcrud.PostgreSQL || this.dbType == gosqlcrud.Oracle
+	return nullsLargest == c.Desc
+}
+
+// orderByClause renders order for the database. NULLS FIRST and NULLS LAST are
+// emulated on MySQL and SQL Server.
+func (this *Database) orderByClause(order []*orderColumn) string {
+	items := []string{}
+	for _, c := range order {
+		direction := " ASC"
+		if c.Desc {
+			direction = " DESC"
+		}
+		switch {
+		case c.Nulls == "":
+			items = append(items, c.Column+direction)
+		case this.dbType == gosqlcrud.MySQL || this.dbType == gosqlcrud.SQLServer:
+			first, last := 0, 1
+			if c.Nulls == "LAST" {
+				first, last = 1, 0
+			}
+			items = append(items, fmt.Sprintf("CASE WHEN %s IS NULL THEN %d ELSE %d END", c.Column, first, last), c.Column+direction)
+		default:
+			items = append(items, c.Column+direction+" NULLS "+c.Nulls)
+		}
+	}
+	return "ORDER BY " + strings.Join(items, ", ")
+}
+
+// keysetWhere builds the condition that selects the rows after the row with
+// cursorValues in order. NULLs are placed as in the ORDER BY clause.
+// Placeholders are numbered from startIndex.
+func (this *Database) keysetWhere(order []*orderColumn, cursorValues []any, startIndex int) (string, []any) {
+	conditions := []string{}
+	values := []any{}
+	for i, c := range order {
+		nullsFirst := this.nullsFirst(c)
+		if cursorValues[i] == nil && !nullsFirst {
+			// no row sorts after NULLs at the end
+			continue
+		}
+		terms := []string{}
+		for j := range i {
+			if cursorValues[j] == nil {
+				terms = append(terms, order[j].Column+" IS NULL")
+				continue
+			}
+			terms = append(terms, fmt.Sprintf("%s = %s", order[j].Column, gosqlcrud.GetPlaceHolder(startIndex+len(values), this.dbType)))
+			values = append(values, cursorValues[j])
+		}
+		if cursorValues[i] == nil {
+			terms = append(terms, c.Column+" IS NOT NULL")
+		} else {
+			operator := ">"
+			if c.Desc {
+				operator = "<"
+			}
+			term := fmt.Sprintf("%s %s %s", c.Column, operator, gosqlcrud.GetPlaceHolder(startIndex+len(values), this.dbType))
+			values = append(values, cursorValues[i])
+			if !nullsFirst && !c.NotNull {
+				term = fmt.Sprintf("%s OR %s IS NULL", term, c.Column)
+				if len(terms) > 0 {
+					term = "(" + term + ")"
+				}
+			}
+			terms = append(terms, term)
+		}
+		conditions = append(conditions, "("+strings.Join(terms, " AND ")+")")
+	}
+	if len(conditions) == 0 {
+		return " AND 1=0", values
+	}
+	return fmt.Sprintf(" AND (%s)", strings.Join(conditions, " OR ")), values
+}
+
+// cursorColumnPrefix starts the names under which the order columns are
+// selected for cursors.
+const cursorColumnPrefix = "GOSQLAPI_CURSOR_"
+
+func cursorColumn(i int) string {
+	return cursorColumnPrefix + strconv.Itoa(i)
+}
+
+type cursor struct {
+	Order  string `json:"o"`
+	Values []any  `json:"v"`
+}
+
+// cursorOrder identifies the order a cursor is made for.
+func cursorOrder(order []*orderColumn) string {
+	items := []string{}
+	for _, c := range order {
+		item := c.Column
+		if c.Desc {
+			item = "-" + item
+		}
+		if c.Nulls != "" {
+			item += ".nulls" + strings.ToLower(c.Nulls)
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ",")
+}
+
+// encodeCursor returns the cursor that points at row in order. The cursor is
+// sealed with key, as it holds the values of order columns that the client may
+// not be allowed to read.
+func encodeCursor(key []byte, order []*orderColumn, row map[string]any) (string, error) {
+	c := &cursor{Order: cursorOrder(order)}
+	for _, column := range order {
+		value, ok := rowValue(row, column.Column)
+		if !ok {
+			return "", badRequest("column %s must be listed to paginate with a cursor", column.Column)
+		}
+		c.Values = append(c.Values, value)
+	}
+	cursorBytes, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cursorCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, cursorBytes, nil)), nil
+}
+
+// decodeCursor returns the values of the row the cursor points at. The cursor
+// must have been sealed with key for the same order.
+func decodeCursor(key []byte, s string, order []*orderColumn) ([]any, error) {
+	aead, err := cursorCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, badRequest("invalid cursor")
+	}
+	cursorBytes, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, badRequest("invalid cursor")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(cursorBytes))
+	decoder.UseNumber()
+	c := &cursor{}
+	if err := decoder.Decode(c); err != nil {
+		return nil, badRequest("invalid cursor")
+	}
+	if c.Order != cursorOrder(order) || len(c.Values) != len(order) {
+		return nil, badRequest("cursor does not match the order")
+	}
+	for i, value := range c.Values {
+		if number, ok := value.(json.Number); ok {
+			if n, err := number.Int64(); err == nil {
+				c.Values[i] = n
+			} else if f, err := number.Float64(); err == nil {
+				c.Values[i] = f
+			}
+		}
+	}
+	return c.Values, nil
+}
+
+// buildCursorKey sets the key sealing cursors, derived from web.cursor_secret.
+// Without it, a random key is kept across reloads, and cursors are only valid
+// until a restart.
+func (this *App) buildCursorKey(prev *App) error {
+	if this.Web.CursorSecret != "" {
+		key := sha256.Sum256([]byte(resolveEnv(this.Web.CursorSecret)))
+		this.cursorKey = key[:]
+		return nil
+	}
+	if prev != nil && prev.Web.CursorSecret == "" {
+		this.cursorKey = prev.cursorKey
+		return nil
+	}
+	this.cursorKey = make([]byte, 32)
+	_, err := rand.Read(this.cursorKey)
+	return err
+}
+
+func cursorCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keysetPage returns a page of pageSize rows after the cursor, and the cursor of
+// the next page, or nil if there is no next page. An empty cursor returns the
+// first page.
+func (this *Database) keysetPage(ctx context.Context, conn gosqlcrud.DB, table *Table, columns string, where string, values []any, pageSize int, order []*orderColumn, cursorParam string) ([]map[string]any, any, error) {
+	order = table.keysetOrder(order)
+	if cursorParam != "" {
+		cursorValues, err := decodeCursor(this.cursorKey, cursorParam, order)
+		if err != nil {
+			return nil, nil, err
+		}
+		keysetWhere, keysetValues := this.keysetWhere(order, cursorValues, len(values))
+		where += keysetWhere
+		values = append(slices.Clone(values), keysetValues...)
+	}
+	// the order columns may not be listed, or be renamed, so they are
+	// selected again under names of their own, which are left out of the rows
+	selectColumns := columns
+	if columns != "*" {
+		for i, c := range order {
+			selectColumns += fmt.Sprintf(", %s AS %s", c.Column, cursorColumn(i))
+		}
+	}
+	q := fmt.Sprintf(`SELECT %s FROM %s WHERE 1=1 %s %s %s`, selectColumns, table.Name, where, this.orderByClause(order), this.GetLimitClause(pageSize+1, 0))
+	data, err := this.queryToMaps(ctx, conn, table.Name+" list", nil, q, values...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var last map[string]any
+	if len(data) > pageSize {
+		data = data[:pageSize]
+		last = data[pageSize-1]
+	}
+	if columns != "*" {
+		if last != nil {
+			cursorRow := map[string]any{}
+			for i, c := range order {
+				cursorRow[c.Column], _ = rowValue(last, cursorColumn(i))
+			}
+			last = cursorRow
+		}
+		for _, row := range data {
+			for k := range row {
+				if strings.HasPrefix(strings.ToUpper(k), cursorColumnPrefix) {
+					delete(row, k)
+				}
+			}
+		}
+	}
+	if last == nil {
+		return data, nil, nil
+	}
+	nextCursor, err := encodeCursor(this.cursorKey, order, last)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, nextCursor, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// pingTimeout is how long a database has to answer the ping on start and
+// reload.
+const pingTimeout = 10 * time.Second
+
+// openDB opens a connection pool to url, the primary or a replica of the
+// database, running the init SQL of the database on each new connection.
+func (this *Database) openDB(url string) (*sql.DB, error) {
+	db, err := sql.Open(this.Type, url)
+	if err != nil || len(this.InitSQL) == 0 {
+		return db, err
+	}
+	d := db.Driver()
+	db.Close()
+	var connector driver.Connector = &dsnConnector{driver: d, dsn: url}
+	if driverContext, ok := d.(driver.DriverContext); ok {
+		connector, err = driverContext.OpenConnector(url)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(&initConnector{Connector: connector, initSQL: this.InitSQL}), nil
+}
+
+// configurePool applies the pool settings of the database to the connection
+// pools of its primary and replicas.
+func (this *Database) configurePool() {
+	conns := []*sql.DB{this.conn}
+	if this.replicas != nil {
+		for _, r := range this.replicas.replicas {
+			conns = append(conns, r.conn)
+		}
+	}
+	for _, conn := range conns {
+		conn.SetMaxOpenConns(this.MaxOpenConns)
+		if this.MaxIdleConns != 0 {
+			conn.SetMaxIdleConns(this.MaxIdleConns)
+		} else {
+			conn.SetMaxIdleConns(2)
+		}
+		conn.SetConnMaxLifetime(time.Duration(this.ConnMaxLifetime) * time.Second)
+		conn.SetConnMaxIdleTime(time.Duration(this.ConnMaxIdleTime) * time.Second)
+	}
+}
+
+// configurePools applies the pool settings of the databases to the pools they
+// took over from the previous app.
+func (this *App) configurePools() {
+	for _, database := range this.Databases {
+		database.mu.Lock()
+		if database.conn != nil {
+			database.configurePool()
+		}
+		database.mu.Unlock()
+	}
+}
+
+// pingDatabases checks that the databases with ping set are reachable, and
+// ejects their unreachable replicas.
+func (this *App) pingDatabases() error {
+	for databaseId, database := range this.Databases {
+		if !database.Ping {
+			continue
+		}
+		conn, err := database.GetConn()
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+			err = conn.PingContext(ctx)
+			cancel()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to ping database %s, %v", databaseId, err)
+		}
+		database.mu.Lock()
+		replicas := database.replicas
+		database.mu.Unlock()
+		if replicas != nil {
+			replicas.check()
+		}
+	}
+	return nil
+}
+
+// dsnConnector opens connections of drivers that do not implement
+// driver.DriverContext.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (this *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return this.driver.Open(this.dsn)
+}
+
+func (this *dsnConnector) Driver() driver.Driver {
+	return this.driver
+}
+
+// initConnector runs initSQL on each connection it opens.
+type initConnector struct {
+	driver.Connector
+	initSQL []string
+}
+
+func (this *initConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := this.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range this.initSQL {
+		if err := execConn(ctx, conn, q); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to run init sql %s, %v", q, err)
+		}
+	}
+	return conn, nil
+}
+
+// execConn runs q on a driver connection.
+func execConn(ctx context.Context, conn driver.Conn, q string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, q, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, q)
+	} else {
+		stmt, err = conn.Prepare(q)
+	}
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if execer, ok := stmt.(driver.StmtExecContext); ok {
+		_, err = execer.ExecContext(ctx, nil)
+	} else {
+		_, err = stmt.Exec(nil)
+	}
+	return err
+}
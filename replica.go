@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaCheckInterval is how often the replicas of a database are pinged.
+	replicaCheckInterval = 10 * time.Second
+	// replicaPingTimeout is how long a replica has to answer a ping before it is
+	// ejected.
+	replicaPingTimeout = 5 * time.Second
+)
+
+// replica is a read replica of a database, which serves reads while it is
+// healthy.
+type replica struct {
+	conn    *sql.DB
+	healthy atomic.Bool
+}
+
+// replicaSet routes the reads of a database to its healthy replicas by round
+// robin, and pings the replicas to eject those that are unhealthy and readmit
+// those that recovered.
+type replicaSet struct {
+	databaseId string
+	replicas   []*replica
+	next       atomic.Uint64
+	done       chan struct{}
+}
+
+// openReplicas opens the connection pools of the replicas of the database.
+func (this *Database) openReplicas() error {
+	if len(this.Replicas) == 0 {
+		return nil
+	}
+	replicas := &replicaSet{databaseId: this.id, done: make(chan struct{})}
+	for i := range this.Replicas {
+		this.Replicas[i] = resolveEnv(this.Replicas[i])
+		conn, err := this.openDB(this.Replicas[i])
+		if err != nil {
+			replicas.close()
+			return err
+		}
+		r := &replica{conn: conn}
+		r.healthy.Store(true)
+		replicas.replicas = append(replicas.replicas, r)
+	}
+	this.replicas = replicas
+	go replicas.run()
+	return nil
+}
+
+// readConn returns the connection pool to read from, a healthy replica or the
+// primary if there is none.
+func (this *Database) readConn() (*sql.DB, error) {
+	conn, err := this.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	this.mu.Lock()
+	replicas := this.replicas
+	this.mu.Unlock()
+	if replica := replicas.pick(); replica != nil {
+		return replica, nil
+	}
+	return conn, nil
+}
+
+// pick returns the next healthy replica, or nil if there is none.
+func (this *replicaSet) pick() *sql.DB {
+	if this == nil {
+		return nil
+	}
+	n := uint64(len(this.replicas))
+	start := this.next.Add(1) - 1
+	for i := range n {
+		if r := this.replicas[(start+i)%n]; r.healthy.Load() {
+			return r.conn
+		}
+	}
+	return nil
+}
+
+func (this *replicaSet) run() {
+	this.check()
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.check()
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// check pings the replicas, ejecting those that fail and readmitting those
+// that answer again.
+func (this *replicaSet) check() {
+	for i, r := range this.replicas {
+		select {
+		case <-this.done:
+			return
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), replicaPingTimeout)
+		err := r.conn.PingContext(ctx)
+		cancel()
+		if err != nil && r.healthy.Swap(false) {
+			log.Printf("Ejected replica %d of database %s, %v\n", i, this.databaseId, err)
+		} else if err == nil && !r.healthy.Swap(true) {
+			log.Printf("Readmitted replica %d of database %s\n", i, this.databaseId)
+		}
+	}
+}
+
+// close stops the health checks and closes the connection pools of the
+// replicas.
+func (this *replicaSet) close() {
+	if this == nil {
+		return
+	}
+	close(this.done)
+	for _, r := range this.replicas {
+		r.conn.Close()
+	}
+}
+
+// getConn returns the connection pool for a request, a replica if read is
+// true and the request does not ask for the primary with .primary.
+func (this *Database) getConn(read bool, params map[string]any) (*sql.DB, error) {
+	if read && !paramBool(params[".primary"], false) {
+		return this.readConn()
+	}
+	return this.GetConn()
+}
+
+// isQueryOnly tells whether statements only query the database.
+func isQueryOnly(statements []*Statement) bool {
+	queryOnly := false
+	for _, statement := range statements {
+		if statement.SQL == "" {
+			continue
+		}
+		if !statement.Query {
+			return false
+		}
+		queryOnly = true
+	}
+	return queryOnly
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+// preferRepresentation tells whether the client asks for the written record
+// with the Prefer: return=representation header.
+func preferRepresentation(r *http.Request) bool {
+	for _, prefer := range r.Header.Values("Prefer") {
+		for preference := range strings.SplitSeq(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "return=representation") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returningClauses returns the clauses that make an INSERT or UPDATE statement
+// return columns, and whether the dialect has them. output goes before VALUES
+// or WHERE, and returning goes to the end of the statement.
+func (this *Database) returningClauses(columns []string) (output string, returning string, ok bool) {
+	switch this.dbType {
+	case gosqlcrud.PostgreSQL, gosqlcrud.SQLite:
+		columnList := "*"
+		if len(columns) > 0 {
+			columnList = strings.Join(columns, ", ")
+		}
+		return "", " RETURNING " + columnList, true
+	case gosqlcrud.SQLServer:
+		inserted := []string{"INSERTED.*"}
+		if len(columns) > 0 {
+			inserted = []string{}
+			for _, column := range columns {
+				inserted = append(inserted, "INSERTED."+column)
+			}
+		}
+		return " OUTPUT " + strings.Join(inserted, ", "), "", true
+	}
+	return "", "", false
+}
+
+// writeRowReturning inserts or updates a record, and returns the record as it is
+// written, or nil if no record is written. The record is returned by the write
+// statement where the dialect allows it, otherwise it is selected in the same
+// transaction.
+func writeRowReturning(ctx context.Context, db *sql.DB, method string, database *Database, table *Table, key []any, params map[string]any, access *Access, rowFilters map[string]any) (map[string]any, error) {
+	columns := table.GetReadableColumns(access)
+	upsert := method == http.MethodPost && paramBool(params[".upsert"], table.Upsert)
+	if output, returning, ok := database.returningClauses(columns); ok && !upsert {
+		var q string
+		var values []any
+		var err error
+		label := table.Name + " insert"
+		if method == http.MethodPost {
+			q, values, err = insertStatement(database, table, params, access, rowFilters, output, returning)
+		} else {
+			label = table.Name + " update"
+			q, values, err = updateStatement(database, table, key, params, access, rowFilters, output, returning)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r, err := database.queryToMaps(ctx, db, label, nil, q, values...)
+		if err != nil {
+			return nil, err
+		}
+		if len(r) == 0 {
+			return nil, nil
+		}
+		return r[0], nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]int64
+	if method == http.MethodPost {
+		result, err = insertRow(ctx, tx, database, table, params, access, rowFilters)
+	} else {
+		result, err = updateRow(ctx, tx, database, table, key, params, access, rowFilters)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	key, err = writtenKey(table, key, params, result)
+	if err != nil || key == nil {
+		tx.Rollback()
+		return nil, err
+	}
+	r, err := selectRow(ctx, tx, database, table, key, columns, rowFilters)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// writtenKey returns the key of a record after it is written with params, or nil
+// if no record is written. key is the key before the write, or nil for a new
+// record.
+func writtenKey(table *Table, key []any, params map[string]any, result map[string]int64) ([]any, error) {
+	if key == nil {
+		if newKey, ok := table.KeyFromMap(params); ok {
+			return newKey, nil
+		}
+		if lastInsertId := result["last_insert_id"]; len(table.PrimaryKey) == 1 && lastInsertId != 0 {
+			return []any{lastInsertId}, nil
+		}
+		return nil, badRequest("primary key %s is required to return the record", table.PrimaryKey)
+	}
+	if result["rows_affected"] == 0 {
+		return nil, nil
+	}
+	// the record moves if its primary key is updated
+	key = slices.Clone(key)
+	for i, column := range table.PrimaryKey {
+		if value, ok := rowValue(params, column); ok {
+			key[i] = value
+		}
+	}
+	return key, nil
+}
+
+// selectRows returns the records of keys as they are in conn. A key that is not
+// found, or is not known, returns a nil record.
+func selectRows(ctx context.Context, conn gosqlcrud.DB, database *Database, table *Table, keys []any, access *Access, rowFilters map[string]any) ([]any, error) {
+	columns := table.GetReadableColumns(access)
+	rows := []any{}
+	for _, key := range keys {
+		if key == nil {
+			rows = append(rows, nil)
+			continue
+		}
+		values, ok := key.([]any)
+		if !ok || len(table.PrimaryKey) == 1 {
+			values = []any{key}
+		}
+		r, err := selectRow(ctx, conn, database, table, values, columns, rowFilters)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
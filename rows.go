@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+// columnsConn keeps the columns of the last query run on it, in the order of
+// the query, which the records of gosqlcrud.QueryToMaps do not keep.
+type columnsConn struct {
+	gosqlcrud.DB
+	columns []string
+}
+
+func (this *columnsConn) Query(q string, args ...any) (*sql.Rows, error) {
+	rows, err := this.DB.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	for i := range columns {
+		columns[i] = strings.ToLower(columns[i])
+	}
+	this.columns = columns
+	return rows, nil
+}
+
+// rowScanner reads the rows of a streamed query into records keyed by the
+// lowercased column names, with the values converted by columnValue as
+// gosqlcrud.QueryToMaps converts the records of buffered responses.
+type rowScanner struct {
+	rows        *sql.Rows
+	columns     []string
+	columnTypes []*sql.ColumnType
+	values      []any
+	pointers    []any
+}
+
+func newRowScanner(rows *sql.Rows) (*rowScanner, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for i := range columns {
+		columns[i] = strings.ToLower(columns[i])
+	}
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	scanner := &rowScanner{
+		rows:        rows,
+		columns:     columns,
+		columnTypes: columnTypes,
+		values:      make([]any, len(columns)),
+		pointers:    make([]any, len(columns)),
+	}
+	for i := range scanner.values {
+		scanner.pointers[i] = &scanner.values[i]
+	}
+	return scanner, nil
+}
+
+// scan returns the current row, after rows.Next.
+func (this *rowScanner) scan() (map[string]any, error) {
+	if err := this.rows.Scan(this.pointers...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]any, len(this.columns))
+	for i, column := range this.columns {
+		row[column] = columnValue(this.columnTypes[i], this.values[i])
+	}
+	return row, nil
+}
+
+// columnValue converts a scanned value to its JSON type as gosqlcrud does.
+// Drivers return numbers such as MySQL decimals as bytes, which are parsed by
+// the database type of the column. Other bytes are strings.
+func columnValue(columnType *sql.ColumnType, value any) any {
+	b, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+	s := string(b)
+	typeName := strings.ToUpper(columnType.DatabaseTypeName())
+	switch {
+	case strings.Contains(typeName, "INT"):
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case strings.Contains(typeName, "DECIMAL"), strings.Contains(typeName, "NUMERIC"), strings.Contains(typeName, "NUMBER"),
+		strings.Contains(typeName, "FLOAT"), strings.Contains(typeName, "DOUBLE"), strings.Contains(typeName, "REAL"):
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
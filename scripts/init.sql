@@ -1,5 +1,7 @@
 drop TABLE IF EXISTS TEST_GOSQLAPI;
 drop TABLE IF EXISTS TEST_GOSQLAPI_TOKENS;
+drop TABLE IF EXISTS TEST_ORDER_LINES;
+drop TABLE IF EXISTS TEST_ORDERS;
 
 create TABLE TEST_GOSQLAPI (
     ID INTEGER NOT NULL PRIMARY KEY,
@@ -24,22 +26,47 @@ create TABLE TEST_GOSQLAPI_TOKENS (
   READ_PRIVATE INT NOT NULL,
   WRITE_PRIVATE INT NOT NULL,
   EXEC_PRIVATE INT NOT NULL,
-  ALLOWED_ORIGINS VARCHAR(1000) NOT NULL
+  ALLOWED_ORIGINS VARCHAR(1000) NOT NULL,
+  ROW_FILTERS VARCHAR(1000) NOT NULL
 );
 create INDEX TOKEN_INDEX ON TEST_GOSQLAPI_TOKENS (TOKEN);
 
 insert INTO 
-TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS)
-VALUES (1,  '1234567890', 'test_db',        'token_table',    1,            0,              0,            'localhost');
+TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS, ROW_FILTERS)
+VALUES (1,  '1234567890', 'test_db',        'token_table',    1,            0,              0,            'localhost', '');
 
 insert INTO 
-TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS)
-VALUES (2,  '0987654321', 'test_db',        'metadata',       0,            0,              1,            'localhost *.example.com');
+TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS, ROW_FILTERS)
+VALUES (2,  '0987654321', 'test_db',        'metadata',       0,            0,              1,            'localhost *.example.com', '');
 
 insert INTO 
-TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS)
-VALUES (3,  'no_access',  'test_db',        '*',              1,            1,              1,            '');
+TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS, ROW_FILTERS)
+VALUES (3,  'no_access',  'test_db',        '*',              1,            1,              1,            '', '');
 
 insert INTO 
-TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS)
-VALUES (4,  'super',      'test_db',        '*',              1,            1,              1,            '*');
\ No newline at end of file
+TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS, ROW_FILTERS)
+VALUES (4,  'super',      'test_db',        '*',              1,            1,              1,            '*', '');
+
+insert INTO 
+TEST_GOSQLAPI_TOKENS (ID, TOKEN,        TARGET_DATABASE,  TARGET_OBJECTS,   READ_PRIVATE, WRITE_PRIVATE,  EXEC_PRIVATE, ALLOWED_ORIGINS, ROW_FILTERS)
+VALUES (5,  'row_filter', 'test_db',        'token_table',    1,            1,              0,            '*',             'ID=5');
+
+create TABLE TEST_ORDER_LINES (
+  ORDER_ID INTEGER NOT NULL,
+  LINE_NO INTEGER NOT NULL,
+  PRODUCT VARCHAR(50),
+  PRIMARY KEY (ORDER_ID, LINE_NO)
+);
+
+insert INTO TEST_ORDER_LINES (ORDER_ID, LINE_NO, PRODUCT) VALUES (1, 1, 'Apple');
+
+insert INTO TEST_ORDER_LINES (ORDER_ID, LINE_NO, PRODUCT) VALUES (1, 2, 'Banana');
+
+create TABLE TEST_ORDERS (
+  ID INTEGER NOT NULL PRIMARY KEY,
+  CUSTOMER VARCHAR(50)
+);
+
+insert INTO TEST_ORDERS (ID, CUSTOMER) VALUES (1, 'Acme');
+
+insert INTO TEST_ORDERS (ID, CUSTOMER) VALUES (2, 'Globex');
@@ -4,6 +4,7 @@ SELECT
     READ_PRIVATE AS read_private,
     WRITE_PRIVATE AS write_private,
     EXEC_PRIVATE AS exec_private,
-    ALLOWED_ORIGINS AS allowed_origins
+    ALLOWED_ORIGINS AS allowed_origins,
+    ROW_FILTERS AS row_filters
 FROM TEST_GOSQLAPI_TOKENS
 WHERE TOKEN = ?token?;
\ No newline at end of file
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+)
+
+// selectColumns parses .select, comma separated columns each optionally
+// aliased as alias:column, and returns the projection of the selected columns.
+// allowedColumns are the columns that can be selected, or nil for all columns of
+// the table. A column selected without an alias keeps the alias it has in
+// allowedColumns, such as `NAME AS USERNAME`.
+func (this *Database) selectColumns(table *Table, selectParam string, allowedColumns []string) ([]string, error) {
+	if len(allowedColumns) == 0 {
+		var err error
+		allowedColumns, err = this.TableColumns(table)
+		if err != nil {
+			return nil, err
+		}
+	}
+	columns := []string{}
+	for item := range strings.SplitSeq(selectParam, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		alias, column, aliased := strings.Cut(item, ":")
+		if !aliased {
+			column = alias
+		}
+		alias = strings.TrimSpace(alias)
+		column = strings.TrimSpace(column)
+		if !reColumnName.MatchString(column) || !reColumnName.MatchString(alias) {
+			return nil, badRequest("invalid select %s", item)
+		}
+		if !columnAllowed(allowedColumns, column) {
+			return nil, badRequest("column %s cannot be selected", column)
+		}
+		if aliased {
+			columns = append(columns, column+" AS "+alias)
+		} else if allowedColumn := findColumn(allowedColumns, column); len(strings.Fields(allowedColumn)) > 1 {
+			columns = append(columns, allowedColumn)
+		} else {
+			columns = append(columns, column)
+		}
+	}
+	if len(columns) == 0 {
+		return nil, badRequest("no columns selected")
+	}
+	return columns, nil
+}
+
+// findColumn returns the entry of columns for column, matching `NAME AS
+// USERNAME` by its source column NAME, or an empty string if there is none.
+func findColumn(columns []string, column string) string {
+	for _, c := range columns {
+		fields := strings.Fields(c)
+		if len(fields) > 0 && strings.EqualFold(fields[0], column) {
+			return c
+		}
+	}
+	return ""
+}
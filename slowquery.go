@@ -0,0 +1,385 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+const (
+	// defaultSlowQueryMaxSize is the size of the slow query log file at which
+	// it is rotated when slow_query.max_size is not set.
+	defaultSlowQueryMaxSize = 10 * 1024 * 1024 // 10MB
+	// defaultSlowQueryMaxFiles is the number of rotated slow query log files
+	// kept when slow_query.max_files is not set.
+	defaultSlowQueryMaxFiles = 5
+	// slowQueryQueueSize is the number of entries waiting to be written to the
+	// slow query table, beyond which entries are dropped.
+	slowQueryQueueSize = 1000
+)
+
+// slowQueryLog writes the statements slower than the threshold of their
+// database to stderr or a rotating file, and optionally to a table.
+type slowQueryLog struct {
+	config  *SlowQuery
+	logger  *slog.Logger
+	file    *rotatingFile
+	table   *Database
+	entries chan *slowQueryEntry // written to the table by a single worker
+	dropped atomic.Int64         // entries dropped since the last one written
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// slowQueryEntry is an entry of the slow query table.
+type slowQueryEntry struct {
+	databaseId string
+	label      string
+	q          string
+	params     string
+	durationMs float64
+	rows       int64
+}
+
+// newSlowQueryLog returns the slow query log of config, reusing the log file of
+// prev when its path did not change.
+func newSlowQueryLog(config *SlowQuery, prev *slowQueryLog) (*slowQueryLog, error) {
+	this := &slowQueryLog{config: config}
+	var w io.Writer = os.Stderr
+	if config.File != "" {
+		if prev != nil && prev.file != nil && prev.file.path == config.File {
+			this.file = prev.file
+			this.file.setLimits(config.MaxSize, config.MaxFiles)
+		} else {
+			file, err := openRotatingFile(config.File, config.MaxSize, config.MaxFiles)
+			if err != nil {
+				return nil, err
+			}
+			this.file = file
+		}
+		w = this.file
+	}
+	this.logger = slog.New(slog.NewJSONHandler(w, nil))
+	return this, nil
+}
+
+// startTable starts the worker writing the entries to the slow query table of
+// database.
+func (this *slowQueryLog) startTable(database *Database) {
+	this.table = database
+	this.entries = make(chan *slowQueryEntry, slowQueryQueueSize)
+	this.stop = make(chan struct{})
+	this.stopped = make(chan struct{})
+	go this.run()
+}
+
+// run writes the entries to the slow query table until the log is closed, and
+// then writes the entries still queued.
+func (this *slowQueryLog) run() {
+	defer close(this.stopped)
+	for {
+		select {
+		case entry := <-this.entries:
+			this.insert(entry)
+		case <-this.stop:
+			for {
+				select {
+				case entry := <-this.entries:
+					this.insert(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops the worker of the slow query table, and closes the log file
+// unless it is shared with other.
+func (this *slowQueryLog) close(other *slowQueryLog) {
+	if this == nil {
+		return
+	}
+	if this.stop != nil {
+		select {
+		case <-this.stop:
+		default:
+			close(this.stop)
+		}
+		<-this.stopped
+	}
+	if this.file == nil || (other != nil && other.file == this.file) {
+		return
+	}
+	this.file.Close()
+}
+
+// log writes the entry of a slow statement of databaseId.
+func (this *slowQueryLog) log(databaseId string, label string, q string, params []string, args []any, duration time.Duration, rows int64) {
+	if len(params) == 0 {
+		// the parameters of table statements are positional
+		for i := range args {
+			params = append(params, "$"+strconv.Itoa(i+1))
+		}
+	}
+	durationMs := float64(duration.Microseconds()) / 1000
+	attrs := []slog.Attr{
+		slog.String("db", databaseId),
+		slog.String("label", label),
+		slog.String("sql", q),
+		slog.Any("params", params),
+		slog.Float64("duration_ms", durationMs),
+		slog.Int64("rows", rows),
+	}
+	if this.config.LogParams {
+		attrs = append(attrs, slog.Any("values", args))
+	}
+	this.logger.LogAttrs(context.Background(), slog.LevelWarn, "slow query", attrs...)
+
+	if this.table != nil {
+		values := any(nil)
+		if this.config.LogParams {
+			values = args
+		}
+		entry, _ := json.Marshal(map[string]any{"params": params, "values": values})
+		select {
+		case this.entries <- &slowQueryEntry{databaseId, label, q, string(entry), durationMs, rows}:
+		default:
+			// the table is slower than the statements logged
+			this.dropped.Add(1)
+		}
+	}
+}
+
+// insert writes an entry to the slow query table. It runs in the worker so
+// that the request does not wait for the table, which may be locked by the
+// transaction of the slow statement.
+func (this *slowQueryLog) insert(entry *slowQueryEntry) {
+	if dropped := this.dropped.Swap(0); dropped > 0 {
+		log.Printf("ERROR slow query log queue full, dropped %d entries of %s\n", dropped, this.config.Table)
+	}
+	conn, err := this.table.GetConn()
+	if err == nil {
+		placeholders := []string{}
+		for i := range 7 {
+			placeholders = append(placeholders, gosqlcrud.GetPlaceHolder(i, this.table.dbType))
+		}
+		_, err = conn.Exec(fmt.Sprintf(`INSERT INTO %s (DB, LABEL, SQL_TEXT, PARAMS, DURATION_MS, ROW_COUNT, CREATED_AT) VALUES (%s)`,
+			this.config.Table, strings.Join(placeholders, ", ")),
+			entry.databaseId, entry.label, entry.q, entry.params, entry.durationMs, entry.rows, time.Now().UTC())
+	}
+	if err != nil {
+		log.Printf("ERROR writing slow query log to %s, %v\n", this.config.Table, err)
+	}
+}
+
+// buildSlowQueryLog sets up the slow query log when a threshold is set,
+// globally in slow_query or for a database.
+func (this *App) buildSlowQueryLog(prev *App) error {
+	config := this.SlowQuery
+	enabled := config != nil && config.Threshold > 0
+	for _, database := range this.Databases {
+		enabled = enabled || database.SlowQueryThreshold > 0
+	}
+	if !enabled {
+		return nil
+	}
+	if config == nil {
+		config = &SlowQuery{}
+	}
+	var prevLog *slowQueryLog
+	if prev != nil {
+		prevLog = prev.slowQueryLog
+	}
+	slowLog, err := newSlowQueryLog(config, prevLog)
+	if err != nil {
+		return err
+	}
+	if config.Database != "" {
+		slowLog.startTable(this.Databases[config.Database])
+	}
+	this.slowQueryLog = slowLog
+	for _, database := range this.Databases {
+		database.slowQueryLog = slowLog
+		database.slowThreshold = time.Duration(cmp.Or(database.SlowQueryThreshold, config.Threshold)) * time.Millisecond
+	}
+	return nil
+}
+
+type statementTemplateKey struct{}
+
+// statementTemplate is the SQL of a script statement before the request
+// parameters such as !authorization! are replaced, and the names and values of
+// these parameters. Statements are traced and logged with it, so that request
+// headers are only logged as parameter values.
+type statementTemplate struct {
+	sql    string
+	params []string
+	values []any
+}
+
+// withStatementTemplate returns ctx recording its statements as template.
+func withStatementTemplate(ctx context.Context, template *statementTemplate) context.Context {
+	return context.WithValue(ctx, statementTemplateKey{}, template)
+}
+
+// startStatement starts a statement of label, and returns the function to call
+// with the rows returned or affected once it is done. The statement is traced
+// as a span of ctx, and logged if it took longer than the slow query threshold
+// of the database. params are the names of the parameters, or nil if they are
+// positional. The statement template of ctx, if any, is recorded in place of q.
+func (this *Database) startStatement(ctx context.Context, label string, q string, params []string, args []any) func(rows int64, err error) {
+	name := label
+	if name == "" {
+		name = "statement"
+	}
+	_, statementSpan := startSpan(ctx, name, spanKindClient)
+	statementSpan.setAttribute("db.system", dbSystems[this.dbType])
+	statementSpan.setAttribute("db.namespace", this.id)
+	if template, ok := ctx.Value(statementTemplateKey{}).(*statementTemplate); ok {
+		q = template.sql
+		params = append(slices.Clip(params), template.params...)
+		args = append(slices.Clip(args), template.values...)
+	}
+	statementSpan.setAttribute("db.query.text", q)
+	statementSpan.setAttribute("gosqlapi.statement.label", label)
+	start := time.Now()
+	return func(rows int64, err error) {
+		statementSpan.setAttribute("gosqlapi.statement.rows", rows)
+		statementSpan.setError(err)
+		statementSpan.finish()
+		if this.slowQueryLog == nil || this.slowThreshold <= 0 {
+			return
+		}
+		if duration := time.Since(start); duration >= this.slowThreshold {
+			this.slowQueryLog.log(this.id, label, q, params, args, duration, rows)
+		}
+	}
+}
+
+// queryToMaps runs q on conn like gosqlcrud.QueryToMaps, as a statement of
+// label.
+func (this *Database) queryToMaps(ctx context.Context, conn gosqlcrud.DB, label string, params []string, q string, args ...any) ([]map[string]any, error) {
+	done := this.startStatement(ctx, label, q, params, args)
+	columnsConn := &columnsConn{DB: withContext(ctx, conn)}
+	data, err := gosqlcrud.QueryToMaps(columnsConn, q, args...)
+	done(int64(len(data)), err)
+	if err != nil {
+		return nil, err
+	}
+	setQueryColumns(ctx, label, columnsConn.columns)
+	return data, nil
+}
+
+// exec runs q on conn like gosqlcrud.Exec, as a statement of label.
+func (this *Database) exec(ctx context.Context, conn gosqlcrud.DB, label string, params []string, q string, args ...any) (map[string]int64, error) {
+	done := this.startStatement(ctx, label, q, params, args)
+	result, err := gosqlcrud.Exec(withContext(ctx, conn), q, args...)
+	done(result["rows_affected"], err)
+	return result, err
+}
+
+// rotatingFile is a log file which is renamed to path.1 once it reaches
+// maxSize, keeping maxFiles rotated files.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	this := &rotatingFile{path: path}
+	this.setLimits(maxSize, maxFiles)
+	if err := this.open(); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *rotatingFile) setLimits(maxSize int64, maxFiles int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.maxSize = maxSize
+	if this.maxSize <= 0 {
+		this.maxSize = defaultSlowQueryMaxSize
+	}
+	this.maxFiles = maxFiles
+	if this.maxFiles <= 0 {
+		this.maxFiles = defaultSlowQueryMaxFiles
+	}
+}
+
+func (this *rotatingFile) open() error {
+	file, err := os.OpenFile(this.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.file = file
+	this.size = info.Size()
+	return nil
+}
+
+func (this *rotatingFile) Write(p []byte) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.file == nil {
+		return 0, os.ErrClosed
+	}
+	if this.size > 0 && this.size+int64(len(p)) > this.maxSize {
+		if err := this.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := this.file.Write(p)
+	this.size += int64(n)
+	return n, err
+}
+
+// rotate renames path.N-1 to path.N down to path to path.1, dropping the
+// oldest file, and opens a new file at path.
+func (this *rotatingFile) rotate() error {
+	if err := this.file.Close(); err != nil {
+		return err
+	}
+	this.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", this.path, this.maxFiles))
+	for i := this.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", this.path, i), fmt.Sprintf("%s.%d", this.path, i+1))
+	}
+	if err := os.Rename(this.path, this.path+".1"); err != nil {
+		return err
+	}
+	return this.open()
+}
+
+func (this *rotatingFile) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
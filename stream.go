@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+const (
+	// streamFlushRows is the number of rows written between flushes.
+	streamFlushRows = 100
+	// streamWriteTimeout extends the write deadline of the response at each
+	// flush, so that a stream is not cut by the write timeout of the server
+	// while it is making progress.
+	streamWriteTimeout = 30 * time.Second
+	// defaultMaxStreamRows caps the rows of a streamed response when
+	// web.max_stream_rows is not set.
+	defaultMaxStreamRows = 1000000
+)
+
+// rowStreamer writes the rows of queries to the response as they are read, as
+// a JSON array, newline delimited JSON or CSV. When the response is labeled,
+// each query or statement result is a section of the response named by its
+// label, as in a JSON object keyed by label.
+type rowStreamer struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	format   string
+	maxRows  int
+	labeled  bool
+	rows     int
+	sections int
+	began    bool
+	csv      *csv.Writer
+}
+
+// newRowStreamer returns a streamer writing to w in format, which fails once
+// more than maxRows rows are written.
+func newRowStreamer(w http.ResponseWriter, format string, maxRows int) (*rowStreamer, error) {
+	if format == formatXLSX {
+		return nil, badRequest("format %s cannot be streamed", format)
+	}
+	return &rowStreamer{
+		w:       w,
+		rc:      http.NewResponseController(w),
+		format:  format,
+		maxRows: maxRows,
+		csv:     csv.NewWriter(w),
+	}, nil
+}
+
+// started tells whether anything is written to the response, after which
+// errors can no longer be reported with a status code.
+func (this *rowStreamer) started() bool {
+	return this.began
+}
+
+// abort logs err and aborts the response, so that the client sees an
+// incomplete response rather than a complete one missing rows.
+func (this *rowStreamer) abort(err error) {
+	log.Printf("ERROR streaming response: %v\n", err)
+	panic(http.ErrAbortHandler)
+}
+
+func (this *rowStreamer) begin() error {
+	if this.began {
+		return nil
+	}
+	this.began = true
+	this.w.Header().Set("Content-Type", formatContentTypes[this.format])
+	this.w.WriteHeader(http.StatusOK)
+	if this.format == formatJSON && this.labeled {
+		_, err := io.WriteString(this.w, "{")
+		return err
+	}
+	return nil
+}
+
+// beginSection starts the section of label with the header row columns.
+func (this *rowStreamer) beginSection(label string, columns []string) error {
+	if err := this.begin(); err != nil {
+		return err
+	}
+	defer func() { this.sections++ }()
+	switch this.format {
+	case formatJSON:
+		if !this.labeled {
+			return nil
+		}
+		b, _ := json.Marshal(label)
+		prefix := ""
+		if this.sections > 0 {
+			prefix = ","
+		}
+		_, err := io.WriteString(this.w, prefix+string(b)+":")
+		return err
+	case formatCSV:
+		if this.labeled {
+			if this.sections > 0 {
+				this.csv.Flush()
+				if _, err := io.WriteString(this.w, "\n"); err != nil {
+					return err
+				}
+			}
+			if err := this.csv.Write([]string{label}); err != nil {
+				return err
+			}
+		}
+		return this.csv.Write(columns)
+	}
+	return nil
+}
+
+// writeRow writes a row of the section of label. first tells whether it is the
+// first row of a JSON array.
+func (this *rowStreamer) writeRow(label string, columns []string, row map[string]any, first bool) error {
+	switch this.format {
+	case formatJSON:
+		b, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if !first {
+			b = append([]byte{','}, b...)
+		}
+		_, err = this.w.Write(b)
+		return err
+	case formatNDJSON:
+		var line any = row
+		if this.labeled {
+			line = map[string]any{label: row}
+		}
+		b, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		_, err = this.w.Write(append(b, '\n'))
+		return err
+	case formatCSV:
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = cellString(row[column])
+		}
+		return this.csv.Write(record)
+	}
+	return fmt.Errorf("unsupported format %s", this.format)
+}
+
+// query runs q on conn, and streams its rows as the section of label.
+func (this *rowStreamer) query(conn gosqlcrud.DB, label string, q string, args ...any) error {
+	rows, err := conn.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	scanner, err := newRowScanner(rows)
+	if err != nil {
+		return err
+	}
+	columns := scanner.columns
+	if err := this.beginSection(label, columns); err != nil {
+		return err
+	}
+	if this.format == formatJSON {
+		if _, err := io.WriteString(this.w, "["); err != nil {
+			return err
+		}
+	}
+	first := true
+	for rows.Next() {
+		this.rows++
+		if this.rows > this.maxRows {
+			return fmt.Errorf("more than %d rows to stream", this.maxRows)
+		}
+		row, err := scanner.scan()
+		if err != nil {
+			return err
+		}
+		if err := this.writeRow(label, columns, row, first); err != nil {
+			return err
+		}
+		first = false
+		if this.rows%streamFlushRows == 0 {
+			if err := this.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if this.format == formatJSON {
+		if _, err := io.WriteString(this.w, "]"); err != nil {
+			return err
+		}
+	}
+	return this.flush()
+}
+
+// result writes the result of a statement as the section of label.
+func (this *rowStreamer) result(label string, result map[string]int64) error {
+	row := map[string]any{}
+	for k, v := range result {
+		row[k] = v
+	}
+	columns := sortedKeys(row)
+	if err := this.beginSection(label, columns); err != nil {
+		return err
+	}
+	return this.writeRow(label, columns, row, true)
+}
+
+// finish ends the response.
+func (this *rowStreamer) finish() error {
+	if err := this.begin(); err != nil {
+		return err
+	}
+	if this.format == formatJSON {
+		end := "\n"
+		if this.labeled {
+			end = "}\n"
+		}
+		if _, err := io.WriteString(this.w, end); err != nil {
+			return err
+		}
+	}
+	return this.flush()
+}
+
+func (this *rowStreamer) flush() error {
+	this.csv.Flush()
+	if err := this.csv.Error(); err != nil {
+		return err
+	}
+	this.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return this.rc.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+const (
+	// defaultMaxTimeout caps .timeout when web.max_timeout is not set.
+	defaultMaxTimeout = 30 // seconds
+	// statusClientClosedRequest is the status of a request canceled by the
+	// client, which never sees it.
+	statusClientClosedRequest = 499
+)
+
+// contextDB is a connection or transaction that can run statements with a
+// context.
+type contextDB interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// contextConn runs the statements of conn with ctx, so that gosqlcrud helpers
+// are cancelled when ctx ends.
+type contextConn struct {
+	conn contextDB
+	ctx  context.Context
+}
+
+func (this *contextConn) Query(query string, args ...any) (*sql.Rows, error) {
+	return this.conn.QueryContext(this.ctx, query, args...)
+}
+
+func (this *contextConn) Exec(query string, args ...any) (sql.Result, error) {
+	return this.conn.ExecContext(this.ctx, query, args...)
+}
+
+// withContext returns conn running its statements with ctx.
+func withContext(ctx context.Context, conn gosqlcrud.DB) gosqlcrud.DB {
+	if c, ok := conn.(*contextConn); ok {
+		return &contextConn{conn: c.conn, ctx: ctx}
+	}
+	if c, ok := conn.(contextDB); ok {
+		return &contextConn{conn: c, ctx: ctx}
+	}
+	return conn
+}
+
+// requestTimeout returns the timeout of a request to an object of database,
+// which is .timeout if it is set, capped by web.max_timeout, otherwise the
+// timeout of the object or of the database. 0 means no timeout.
+func (this *App) requestTimeout(database *Database, objectTimeout int, params map[string]any) (time.Duration, error) {
+	timeout := time.Duration(cmp.Or(objectTimeout, database.Timeout)) * time.Second
+	if timeoutParam, ok := params[".timeout"]; ok {
+		seconds, err := strconv.ParseFloat(fmt.Sprint(timeoutParam), 64)
+		if err != nil || seconds <= 0 {
+			return 0, badRequest("invalid timeout %v", timeoutParam)
+		}
+		timeout = min(time.Duration(seconds*float64(time.Second)), time.Duration(this.Web.MaxTimeout)*time.Second)
+	}
+	return timeout, nil
+}
+
+// contextError returns err as a 504 error when it is caused by the timeout of
+// ctx, and as a 499 error when the client canceled the request.
+func contextError(ctx context.Context, err error, timeout time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return &StatusError{StatusCode: http.StatusGatewayTimeout, Err: fmt.Errorf("query canceled after the timeout of %v", timeout)}
+	case context.Canceled:
+		return &StatusError{StatusCode: statusClientClosedRequest, Err: fmt.Errorf("request canceled by the client")}
+	}
+	return err
+}
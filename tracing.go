@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+const (
+	// tracingBatchSpans is the number of spans exported in a request.
+	tracingBatchSpans = 512
+	// tracingQueueSpans is the number of spans waiting to be exported, after
+	// which spans are dropped.
+	tracingQueueSpans = 4096
+	// tracingInterval is the longest time a span waits to be exported.
+	tracingInterval = 5 * time.Second
+)
+
+// Kinds of spans in OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+var dbSystems = map[gosqlcrud.DbType]string{
+	gosqlcrud.PostgreSQL: "postgresql",
+	gosqlcrud.MySQL:      "mysql",
+	gosqlcrud.SQLite:     "sqlite",
+	gosqlcrud.SQLServer:  "mssql",
+	gosqlcrud.Oracle:     "oracle",
+}
+
+// span is a span of a trace, exported to an OTLP/HTTP collector when it ends.
+// The methods of a nil span do nothing, so that code can be traced whether
+// tracing is enabled or not.
+type span struct {
+	tracer       *tracer
+	traceId      [16]byte
+	spanId       [8]byte
+	parentSpanId [8]byte
+	name         string
+	kind         int
+	start        time.Time
+	end          time.Time
+	attributes   map[string]any
+	err          string
+	mu           sync.Mutex
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span of ctx, or nil if ctx is not traced.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child span of the span of ctx. It returns ctx and a nil
+// span if ctx is not traced.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer:       parent.tracer,
+		traceId:      parent.traceId,
+		parentSpanId: parent.spanId,
+		name:         name,
+		kind:         kind,
+		start:        time.Now(),
+		attributes:   map[string]any{},
+	}
+	rand.Read(s.spanId[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (this *span) setAttribute(key string, value any) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.attributes[key] = value
+}
+
+// setError marks the span as failed with err, if err is not nil.
+func (this *span) setError(err error) {
+	if this == nil || err == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.err = err.Error()
+}
+
+// finish ends the span and queues it for export.
+func (this *span) finish() {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	this.end = time.Now()
+	this.mu.Unlock()
+	this.tracer.export(this)
+}
+
+// tracer batches ended spans and exports them to an OTLP/HTTP collector.
+type tracer struct {
+	config  Tracing
+	client  *http.Client
+	queue   chan *span
+	flushes chan chan struct{}
+	done    chan struct{}
+}
+
+// newTracer returns a tracer of config, reusing prev when config did not
+// change.
+func newTracer(config *Tracing, prev *tracer) *tracer {
+	if config == nil || config.Endpoint == "" {
+		return nil
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "gosqlapi"
+	}
+	if prev != nil && prev.config.Endpoint == config.Endpoint && prev.config.ServiceName == config.ServiceName &&
+		maps.Equal(prev.config.Headers, config.Headers) {
+		return prev
+	}
+	this := &tracer{
+		config:  *config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *span, tracingQueueSpans),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go this.run()
+	return this
+}
+
+// startServerSpan starts the span of request r, continuing the trace of its
+// traceparent header. It returns a nil span when tracing is disabled or the
+// caller did not sample the trace.
+func (this *tracer) startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	ctx := r.Context()
+	if this == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer:     this,
+		name:       name,
+		kind:       spanKindServer,
+		start:      time.Now(),
+		attributes: map[string]any{},
+	}
+	if traceId, parentSpanId, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		s.traceId = traceId
+		s.parentSpanId = parentSpanId
+	} else {
+		rand.Read(s.traceId[:])
+	}
+	rand.Read(s.spanId[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// finishServerSpan ends the span of a request answered with status.
+func finishServerSpan(s *span, status int) {
+	if s == nil {
+		return
+	}
+	s.setAttribute("http.response.status_code", status)
+	if status >= 500 {
+		s.setError(fmt.Errorf("%s", http.StatusText(status)))
+	}
+	s.finish()
+}
+
+// parseTraceparent parses a W3C traceparent header, version-traceid-spanid-flags.
+func parseTraceparent(header string) (traceId [16]byte, spanId [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceId[:], []byte(parts[1])); err != nil || traceId == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(spanId[:], []byte(parts[2])); err != nil || spanId == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceId, spanId, flags&1 == 1, true
+}
+
+func (this *tracer) export(s *span) {
+	select {
+	case this.queue <- s:
+	default:
+		// the collector is not keeping up, drop the span
+	}
+}
+
+// flush exports the queued spans and waits until they are sent.
+func (this *tracer) flush() {
+	if this == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case this.flushes <- done:
+		<-done
+	case <-this.done:
+	}
+}
+
+// stop exports the queued spans and stops the tracer.
+func (this *tracer) stop() {
+	if this == nil {
+		return
+	}
+	this.flush()
+	close(this.done)
+}
+
+func (this *tracer) run() {
+	ticker := time.NewTicker(tracingInterval)
+	defer ticker.Stop()
+	batch := []*span{}
+	send := func() {
+		if len(batch) > 0 {
+			this.send(batch)
+			batch = []*span{}
+		}
+	}
+	for {
+		select {
+		case s := <-this.queue:
+			batch = append(batch, s)
+			if len(batch) >= tracingBatchSpans {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-this.flushes:
+			for len(this.queue) > 0 {
+				batch = append(batch, <-this.queue)
+			}
+			send()
+			close(done)
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// send posts spans to the collector in the OTLP JSON encoding.
+func (this *tracer) send(spans []*span) {
+	otlpSpans := []any{}
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": this.config.ServiceName}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "gosqlapi", "version": version},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Printf("ERROR exporting spans, %v\n", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, this.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("ERROR exporting spans, %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range this.config.Headers {
+		req.Header.Set(k, resolveEnv(v))
+	}
+	resp, err := this.client.Do(req)
+	if err != nil {
+		log.Printf("ERROR exporting spans, %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Printf("ERROR exporting spans, %s\n", resp.Status)
+	}
+}
+
+// otlp returns the span in the OTLP JSON encoding.
+func (this *span) otlp() map[string]any {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	s := map[string]any{
+		"traceId":           hex.EncodeToString(this.traceId[:]),
+		"spanId":            hex.EncodeToString(this.spanId[:]),
+		"name":              this.name,
+		"kind":              this.kind,
+		"startTimeUnixNano": strconv.FormatInt(this.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(this.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(this.attributes),
+	}
+	if this.parentSpanId != [8]byte{} {
+		s["parentSpanId"] = hex.EncodeToString(this.parentSpanId[:])
+	}
+	if this.err != "" {
+		s["status"] = map[string]any{"code": 2, "message": this.err}
+	}
+	return s
+}
+
+func otlpAttributes(attributes map[string]any) []any {
+	result := []any{}
+	for _, key := range sortedKeys(attributes) {
+		var value map[string]any
+		switch v := attributes[key].(type) {
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]any{"key": key, "value": value})
+	}
+	return result
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elgs/gosqlcrud"
 )
@@ -17,54 +20,134 @@ type App struct {
 	Tables        map[string]*Table    `json:"tables"`
 	Tokens        map[string][]*Access `json:"tokens"`
 	ManagedTokens *ManagedTokens       `json:"managed_tokens"`
+	JWT           *JWT                 `json:"jwt"`
 	CacheTokens   bool                 `json:"cache_tokens"`
 	NullValue     any                  `json:"null_value"`
-	tokenCache  map[string][]*Access
-	tokenCacheMu sync.RWMutex
+	SlowQuery     *SlowQuery           `json:"slow_query"`
+	Tracing       *Tracing             `json:"tracing"`
+	tokenCache    map[string][]*Access
+	tokenCacheMu  sync.RWMutex
+	live          atomic.Pointer[App] // the app serving requests after a reload
+	reloadMu      sync.Mutex
+	requests      int  // requests running on the app
+	retired       bool // replaced by a reload, and closed once drained
+	drained       chan struct{}
+	requestsMu    sync.Mutex
+	metrics       *metrics // shared by the apps of reloads
+	accessLogger  *slog.Logger
+	slowQueryLog  *slowQueryLog
+	tracer        *tracer
+	cursorKey     []byte // shared by the apps of reloads without cursor_secret
 }
 
 type Web struct {
-	HttpAddr    string            `json:"http_addr"`
-	HttpsAddr   string            `json:"https_addr"`
-	CertFile    string            `json:"cert_file"`
-	KeyFile     string            `json:"key_file"`
-	Cors        bool              `json:"cors"`
-	HttpHeaders map[string]string `json:"http_headers"`
-	httpServer  *http.Server
-	httpsServer *http.Server
+	HttpAddr      string            `json:"http_addr"`
+	HttpsAddr     string            `json:"https_addr"`
+	CertFile      string            `json:"cert_file"`
+	KeyFile       string            `json:"key_file"`
+	Cors          bool              `json:"cors"`
+	HttpHeaders   map[string]string `json:"http_headers"`
+	OpenAPI       bool              `json:"openapi"`
+	Metrics       bool              `json:"metrics"`
+	AccessLog     string            `json:"access_log"`      // json or logfmt
+	MaxStreamRows int               `json:"max_stream_rows"` // default to 1000000
+	MaxImportSize int64             `json:"max_import_size"` // default to 1GB
+	MaxTimeout    int               `json:"max_timeout"`     // seconds, caps .timeout, default to 30
+	CursorSecret  string            `json:"cursor_secret"`   // seals cursors, random by default
+	httpServer    *http.Server
+	httpsServer   *http.Server
 }
 
 type Database struct {
-	Type   string `json:"type"`
-	Url    string `json:"url"`
-	dbType gosqlcrud.DbType
-	conn   *sql.DB
-	mu     sync.Mutex
+	Type               string   `json:"type"`
+	Url                string   `json:"url"`
+	SlowQueryThreshold int      `json:"slow_query_threshold"` // milliseconds, overrides slow_query.threshold
+	Timeout            int      `json:"timeout"`              // seconds, 0 means no timeout
+	MaxOpenConns       int      `json:"max_open_conns"`       // 0 means unlimited
+	MaxIdleConns       int      `json:"max_idle_conns"`       // default to 2, negative means none
+	ConnMaxLifetime    int      `json:"conn_max_lifetime"`    // seconds, 0 means forever
+	ConnMaxIdleTime    int      `json:"conn_max_idle_time"`   // seconds, 0 means forever
+	Ping               bool     `json:"ping"`                 // ping the database on start and reload
+	InitSQL            []string `json:"init_sql"`             // run on each new connection
+	Replicas           []string `json:"replicas"`             // urls of read replicas
+	id                 string
+	dbType             gosqlcrud.DbType
+	conn               *sql.DB
+	replicas           *replicaSet
+	mu                 sync.Mutex
+	slowQueryLog       *slowQueryLog
+	slowThreshold      time.Duration
+	cursorKey          []byte
+}
+
+type Tracing struct {
+	Endpoint    string            `json:"endpoint"`     // OTLP/HTTP traces endpoint
+	ServiceName string            `json:"service_name"` // default to gosqlapi
+	Headers     map[string]string `json:"headers"`
+}
+
+type SlowQuery struct {
+	Threshold int    `json:"threshold"`  // milliseconds
+	LogParams bool   `json:"log_params"` // log parameter values
+	File      string `json:"file"`       // default to stderr
+	MaxSize   int64  `json:"max_size"`   // default to 10MB
+	MaxFiles  int    `json:"max_files"`  // default to 5
+	Database  string `json:"database"`   // database of table
+	Table     string `json:"table"`
 }
 
 type Access struct {
-	TargetDatabase     string   `json:"target_database" db:"target_database"`
-	TargetObjectArray  []string `json:"target_objects"`
-	TargetObjects      string   `db:"target_objects"`
-	ReadPrivate        bool     `json:"read_private" db:"read_private"`
-	WritePrivate       bool     `json:"write_private" db:"write_private"`
-	ExecPrivate        bool     `json:"exec_private" db:"exec_private"`
-	AllowedOriginArray []string `json:"allowed_origins"`
-	AllowedOrigins     string   `db:"allowed_origins"`
+	TargetDatabase      string            `json:"target_database" db:"target_database"`
+	TargetObjectArray   []string          `json:"target_objects"`
+	TargetObjects       string            `db:"target_objects"`
+	ReadPrivate         bool              `json:"read_private" db:"read_private"`
+	WritePrivate        bool              `json:"write_private" db:"write_private"`
+	ExecPrivate         bool              `json:"exec_private" db:"exec_private"`
+	AllowedOriginArray  []string          `json:"allowed_origins"`
+	AllowedOrigins      string            `db:"allowed_origins"`
+	RowFilterMap        map[string]string `json:"row_filters"`
+	RowFilters          string            `db:"row_filters"`
+	ReadableColumnArray []string          `json:"readable_columns"`
+	ReadableColumns     string            `db:"readable_columns"`
+	WritableColumnArray []string          `json:"writable_columns"`
+	WritableColumns     string            `db:"writable_columns"`
+	claims              map[string]any
 }
 
 type ManagedTokens struct {
-	Database       string `json:"database"`
-	TableName      string `json:"table_name"`
-	Query          string `json:"query"`
-	QueryPath      string `json:"query_path"`
-	Token          string `json:"token"`
-	TargetDatabase string `json:"target_database"`
-	TargetObjects  string `json:"target_objects"`
-	ReadPrivate    string `json:"read_private"`
-	WritePrivate   string `json:"write_private"`
-	ExecPrivate    string `json:"exec_private"`
-	AllowedOrigins string `json:"allowed_origins"`
+	Database        string `json:"database"`
+	TableName       string `json:"table_name"`
+	Query           string `json:"query"`
+	QueryPath       string `json:"query_path"`
+	Token           string `json:"token"`
+	TargetDatabase  string `json:"target_database"`
+	TargetObjects   string `json:"target_objects"`
+	ReadPrivate     string `json:"read_private"`
+	WritePrivate    string `json:"write_private"`
+	ExecPrivate     string `json:"exec_private"`
+	AllowedOrigins  string `json:"allowed_origins"`
+	RowFilters      string `json:"row_filters"`
+	ReadableColumns string `json:"readable_columns"`
+	WritableColumns string `json:"writable_columns"`
+}
+
+type JWT struct {
+	Secret          string `json:"secret"`          // HS256
+	PublicKeyPath   string `json:"public_key_path"` // RS256 or ES256, PEM encoded
+	JwksPath        string `json:"jwks_path"`       // RS256 or ES256
+	Issuer          string `json:"issuer"`
+	Audience        string `json:"audience"`
+	Leeway          int    `json:"leeway"` // seconds
+	TargetDatabase  string `json:"target_database"`
+	TargetObjects   string `json:"target_objects"`
+	ReadPrivate     string `json:"read_private"`
+	WritePrivate    string `json:"write_private"`
+	ExecPrivate     string `json:"exec_private"`
+	AllowedOrigins  string `json:"allowed_origins"`
+	RowFilters      string `json:"row_filters"`
+	ReadableColumns string `json:"readable_columns"`
+	WritableColumns string `json:"writable_columns"`
+	publicKeys      []*jwtKey
 }
 
 type Statement struct {
@@ -81,19 +164,35 @@ type Script struct {
 	SQL        string `json:"sql"`
 	Path       string `json:"path"`
 	PublicExec bool   `json:"public_exec"`
+	Timeout    int    `json:"timeout"` // seconds, default to the timeout of the database
 	Statements []*Statement
 	built      bool
 	mu         sync.Mutex
 }
 
 type Table struct {
-	Database        string   `json:"database"`
-	Name            string   `json:"name"`
-	PrimaryKey      string   `json:"primary_key"`      // default to "ID"
-	ExportedColumns []string `json:"exported_columns"` // empty means all
-	PublicRead      bool     `json:"public_read"`
-	PublicWrite     bool     `json:"public_write"`
-	PageSize        int      `json:"page_size"`
-	OrderBy         string   `json:"order_by"`
-	ShowTotal       bool     `json:"show_total"`
+	Database        string               `json:"database"`
+	Name            string               `json:"name"`
+	PrimaryKey      Columns              `json:"primary_key"`      // default to "ID"
+	ExportedColumns []string             `json:"exported_columns"` // empty means all
+	ReadableColumns []string             `json:"readable_columns"` // empty means all
+	WritableColumns []string             `json:"writable_columns"` // empty means all
+	PublicRead      bool                 `json:"public_read"`
+	PublicWrite     bool                 `json:"public_write"`
+	PageSize        int                  `json:"page_size"`
+	OrderBy         string               `json:"order_by"`
+	ShowTotal       bool                 `json:"show_total"`
+	Upsert          bool                 `json:"upsert"`
+	ConflictColumns Columns              `json:"conflict_columns"` // default to primary key
+	Relations       map[string]*Relation `json:"relations"`
+	Timeout         int                  `json:"timeout"` // seconds, default to the timeout of the database
+	columns         []string
+	mu              sync.Mutex
+}
+
+// Relation is a table whose records refer to the records of another table by a
+// foreign key, and can be embedded in them with .embed.
+type Relation struct {
+	Table      string  `json:"table"`
+	ForeignKey Columns `json:"foreign_key"` // columns referring to the primary key
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/elgs/gosqlcrud"
+)
+
+// GetConflictColumns returns the columns that identify an existing row on
+// upsert.
+func (this *Table) GetConflictColumns() []string {
+	if len(this.ConflictColumns) > 0 {
+		return this.ConflictColumns
+	}
+	return this.PrimaryKey
+}
+
+// upsertStatement builds a statement that inserts rowCount rows of columns, and
+// updates the rows that already exist with the same conflict columns. Rows
+// outside of rowFilters are never updated. The placeholders are numbered row by
+// row, in the order of columns.
+func (this *Database) upsertStatement(table *Table, columns []string, rowCount int, rowFilters map[string]any) (string, error) {
+	for _, column := range columns {
+		if !reColumnName.MatchString(column) {
+			return "", badRequest("invalid column %s", column)
+		}
+	}
+	conflictColumns := table.GetConflictColumns()
+	for _, conflictColumn := range conflictColumns {
+		if !slices.ContainsFunc(columns, func(column string) bool { return strings.EqualFold(column, conflictColumn) }) {
+			return "", badRequest("conflict column %s is required for upsert", conflictColumn)
+		}
+	}
+	updateColumns := []string{}
+	filterColumns := []string{}
+	for _, column := range columns {
+		if columnAllowed(conflictColumns, column) {
+			continue
+		}
+		if _, ok := rowValue(rowFilters, column); ok {
+			filterColumns = append(filterColumns, column)
+			continue
+		}
+		updateColumns = append(updateColumns, column)
+	}
+
+	rows := []string{}
+	index := 0
+	for range rowCount {
+		placeholders := []string{}
+		for range columns {
+			placeholders = append(placeholders, gosqlcrud.GetPlaceHolder(index, this.dbType))
+			index++
+		}
+		rows = append(rows, strings.Join(placeholders, ", "))
+	}
+	columnList := strings.Join(columns, ", ")
+
+	switch this.dbType {
+	case gosqlcrud.PostgreSQL, gosqlcrud.SQLite:
+		q := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s)`, table.Name, columnList, strings.Join(rows, "), ("), strings.Join(conflictColumns, ", "))
+		if len(updateColumns) == 0 {
+			return q + " DO NOTHING", nil
+		}
+		sets := []string{}
+		for _, column := range updateColumns {
+			sets = append(sets, fmt.Sprintf("%s = excluded.%s", column, column))
+		}
+		q += " DO UPDATE SET " + strings.Join(sets, ", ")
+		if len(filterColumns) > 0 {
+			conditions := []string{}
+			for _, column := range filterColumns {
+				conditions = append(conditions, fmt.Sprintf("%s.%s = excluded.%s", table.Name, column, column))
+			}
+			q += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		return q, nil
+	case gosqlcrud.MySQL:
+		q := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE `, table.Name, columnList, strings.Join(rows, "), ("))
+		if len(updateColumns) == 0 {
+			return q + fmt.Sprintf("%s = %s", conflictColumns[0], conflictColumns[0]), nil
+		}
+		conditions := []string{}
+		for _, column := range filterColumns {
+			conditions = append(conditions, fmt.Sprintf("%s = VALUES(%s)", column, column))
+		}
+		sets := []string{}
+		for _, column := range updateColumns {
+			if len(conditions) > 0 {
+				sets = append(sets, fmt.Sprintf("%s = IF(%s, VALUES(%s), %s)", column, strings.Join(conditions, " AND "), column, column))
+			} else {
+				sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", column, column))
+			}
+		}
+		return q + strings.Join(sets, ", "), nil
+	case gosqlcrud.SQLServer, gosqlcrud.Oracle:
+		var source string
+		if this.dbType == gosqlcrud.SQLServer {
+			source = fmt.Sprintf("(VALUES (%s)) AS src (%s)", strings.Join(rows, "), ("), columnList)
+		} else {
+			selects := []string{}
+			index := 0
+			for range rowCount {
+				fields := []string{}
+				for _, column := range columns {
+					fields = append(fields, fmt.Sprintf("%s AS %s", gosqlcrud.GetPlaceHolder(index, this.dbType), column))
+					index++
+				}
+				selects = append(selects, fmt.Sprintf("SELECT %s FROM dual", strings.Join(fields, ", ")))
+			}
+			source = fmt.Sprintf("(%s) src", strings.Join(selects, " UNION ALL "))
+		}
+		on := []string{}
+		for _, column := range conflictColumns {
+			on = append(on, fmt.Sprintf("tgt.%s = src.%s", column, column))
+		}
+		target := "tgt"
+		if this.dbType == gosqlcrud.SQLServer {
+			target = "AS tgt"
+		}
+		q := fmt.Sprintf(`MERGE INTO %s %s USING %s ON (%s)`, table.Name, target, source, strings.Join(on, " AND "))
+		if len(updateColumns) > 0 {
+			conditions := []string{}
+			for _, column := range filterColumns {
+				conditions = append(conditions, fmt.Sprintf("tgt.%s = src.%s", column, column))
+			}
+			sets := []string{}
+			for _, column := range updateColumns {
+				sets = append(sets, fmt.Sprintf("tgt.%s = src.%s", column, column))
+			}
+			switch {
+			case len(conditions) == 0:
+				q += fmt.Sprintf(" WHEN MATCHED THEN UPDATE SET %s", strings.Join(sets, ", "))
+			case this.dbType == gosqlcrud.SQLServer:
+				q += fmt.Sprintf(" WHEN MATCHED AND %s THEN UPDATE SET %s", strings.Join(conditions, " AND "), strings.Join(sets, ", "))
+			default:
+				q += fmt.Sprintf(" WHEN MATCHED THEN UPDATE SET %s WHERE %s", strings.Join(sets, ", "), strings.Join(conditions, " AND "))
+			}
+		}
+		srcColumns := []string{}
+		for _, column := range columns {
+			srcColumns = append(srcColumns, "src."+column)
+		}
+		q += fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s)", columnList, strings.Join(srcColumns, ", "))
+		if this.dbType == gosqlcrud.SQLServer {
+			q += ";"
+		}
+		return q, nil
+	}
+	return "", fmt.Errorf("upsert is not supported for database type %s", this.Type)
+}
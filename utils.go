@@ -2,14 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 	"unicode"
 
 	"github.com/elgs/gosqlcrud"
@@ -39,21 +43,57 @@ func valuesToMap(keyLowerCase bool, nullValue any, values ...map[string][]string
 	return ret
 }
 
-func Hook(clean func()) {
+func Hook(clean func(), reload func()) {
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		<-sigs
-		if clean != nil {
-			clean()
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				if reload != nil {
+					reload()
+				}
+				continue
+			}
+			if clean != nil {
+				clean()
+			}
+			done <- true
+			return
 		}
-		done <- true
 	}()
 	<-done
 }
 
+// WatchFile polls the file at path and calls onChange whenever its size or
+// modification time changes.
+func WatchFile(path string, interval time.Duration, onChange func()) {
+	var lastModTime time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); err == nil {
+		lastModTime, lastSize = fi.ModTime(), fi.Size()
+	}
+	for range time.Tick(interval) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Equal(lastModTime) && fi.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = fi.ModTime(), fi.Size()
+		onChange()
+	}
+}
+
+func resolveEnv(s string) string {
+	if strings.HasPrefix(s, "env:") {
+		return os.Getenv(strings.TrimPrefix(s, "env:"))
+	}
+	return s
+}
+
 func SqlNormalize(sql *string) {
 	*sql = strings.TrimSpace(*sql)
 	var ret string
@@ -96,6 +136,20 @@ func ReplaceRequestParameters(s *string, r *http.Request) {
 	}
 }
 
+// requestParameters returns the request parameters of s, such as
+// !authorization!, and their values in r.
+func requestParameters(s string, r *http.Request) ([]string, []any) {
+	params := []string{}
+	values := []any{}
+	for _, v := range reRequestParam.FindAllStringSubmatch(s, -1) {
+		if len(v) >= 2 && !slices.Contains(params, v[0]) {
+			params = append(params, v[0])
+			values = append(values, GetMetaDataFromRequest(v[1], r))
+		}
+	}
+	return params, values
+}
+
 func IsQuery(sql string) bool {
 	sqlUpper := strings.ToUpper(strings.TrimSpace(sql))
 	return strings.HasPrefix(sqlUpper, "SELECT") ||
@@ -153,6 +207,35 @@ func ArrayOfStructsToArrayOfPointersOfStructs[T any](a []T) []*T {
 	return b
 }
 
+// StatusError is an error that should be reported with a specific HTTP status
+// code.
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (this *StatusError) Error() string {
+	return this.Err.Error()
+}
+
+func (this *StatusError) Unwrap() error {
+	return this.Err
+}
+
+func badRequest(format string, a ...any) error {
+	return &StatusError{StatusCode: http.StatusBadRequest, Err: fmt.Errorf(format, a...)}
+}
+
+// errorStatus returns the status code carried by err, or defaultStatusCode if
+// err does not carry one.
+func errorStatus(err error, defaultStatusCode int) int {
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode
+	}
+	return defaultStatusCode
+}
+
 func writeJSONError(w http.ResponseWriter, statusCode int, msg string) {
 	if statusCode >= 500 {
 		log.Printf("ERROR %d: %s\n", statusCode, msg)
@@ -162,6 +245,34 @@ func writeJSONError(w http.ResponseWriter, statusCode int, msg string) {
 	w.Write(resp)
 }
 
+// writeJSONRowError reports the index of the row that failed a bulk operation.
+func writeJSONRowError(w http.ResponseWriter, statusCode int, msg string, index int) {
+	if statusCode >= 500 {
+		log.Printf("ERROR %d: row %d: %s\n", statusCode, index, msg)
+	}
+	w.WriteHeader(statusCode)
+	resp, _ := json.Marshal(map[string]any{"error": msg, "index": index})
+	w.Write(resp)
+}
+
+// paramBool parses a boolean request parameter, or returns defaultValue if the
+// parameter is not set.
+func paramBool(param any, defaultValue bool) bool {
+	switch v := param.(type) {
+	case string:
+		return v == "true" || v == "1" || v == "yes"
+	case bool:
+		return v
+	case int:
+		return v == 1
+	case int64:
+		return v == 1
+	case float64:
+		return v == 1
+	}
+	return defaultValue
+}
+
 func Contains[T comparable](s []T, e T) bool {
 	for _, v := range s {
 		if v == e {
@@ -170,3 +281,30 @@ func Contains[T comparable](s []T, e T) bool {
 	}
 	return false
 }
+
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
+
+// parseRowFilters parses whitespace separated COLUMN=value pairs.
+func parseRowFilters(s string) (map[string]string, error) {
+	rowFilters := map[string]string{}
+	for _, pair := range strings.Fields(s) {
+		column, value, ok := strings.Cut(pair, "=")
+		if ok && column != "" {
+			rowFilters[column] = value
+		}
+	}
+	return rowFilters, checkRowFilters(rowFilters)
+}
+
+// checkRowFilters rejects the row filters on invalid column names, which are
+// written into the SQL.
+func checkRowFilters(rowFilters map[string]string) error {
+	for column := range rowFilters {
+		if !reColumnName.MatchString(column) {
+			return fmt.Errorf("invalid row filter column %s", column)
+		}
+	}
+	return nil
+}
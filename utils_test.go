@@ -1,7 +1,29 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
 )
 
 func TestExtractSQLParameter(t *testing.T) {
@@ -40,3 +62,1013 @@ func TestSplitSqlLabel(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildFilterWhere(t *testing.T) {
+	table := &Table{ExportedColumns: []string{"ID", "NAME AS USERNAME", "AGE", "DELETED_AT"}}
+	dbPgx := &Database{Type: "pgx", dbType: gosqlcrud.PostgreSQL}
+
+	where, values, err := dbPgx.BuildFilterWhere(table, map[string]any{
+		"age.gt":        "30",
+		"name.ilike":    "a%",
+		"id.in":         "1,2",
+		"deleted_at.is": nil,
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantWhere := " AND age > $2 AND deleted_at IS NULL AND id IN ($3, $4) AND name ILIKE $5"
+	if where != wantWhere {
+		t.Errorf(`wanted "%s", got "%s"`, wantWhere, where)
+	}
+	wantValues := []any{"30", "1", "2", "a%"}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf(`wanted "%v", got "%v"`, wantValues, values)
+	}
+
+	dbSqlite := &Database{Type: "sqlite", dbType: gosqlcrud.SQLite}
+	where, _, err = dbSqlite.BuildFilterWhere(table, map[string]any{"name.ilike": "a%"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where != " AND LOWER(name) LIKE LOWER(?)" {
+		t.Errorf(`got "%s"`, where)
+	}
+
+	badFilters := []map[string]any{
+		{"password.eq": "x"},
+		{"age.between": "1"},
+		{"age.gt": nil},
+		{"age.is": "x"},
+		{"age or 1=1.eq": "x"},
+	}
+	for _, badFilter := range badFilters {
+		_, _, err := dbSqlite.BuildFilterWhere(table, badFilter, 0)
+		if errorStatus(err, 0) != http.StatusBadRequest {
+			t.Errorf(`%v; wanted bad request, got "%v"`, badFilter, err)
+		}
+	}
+}
+
+func TestRowFilterValues(t *testing.T) {
+	r, err := http.NewRequest("GET", "/test_db/test_table", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("x-tenant", "42")
+	rowFilters, err := parseRowFilters("TENANT_ID=!x-tenant! REGION=$region STATUS=active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := &Access{
+		RowFilterMap: rowFilters,
+		claims:       map[string]any{"region": "eu"},
+	}
+	got, err := access.RowFilterValues(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"TENANT_ID": "42", "REGION": "eu", "STATUS": "active"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf(`wanted "%v", got "%v"`, want, got)
+	}
+
+	access.claims = nil
+	if _, err := access.RowFilterValues(r); err == nil {
+		t.Error("wanted error for missing claim, got nil")
+	}
+
+	if _, err := parseRowFilters("TENANT_ID=1 1=1)--=x"); err == nil {
+		t.Error("wanted error for invalid row filter column, got nil")
+	}
+
+	var public *Access
+	if got, err := public.RowFilterValues(r); got != nil || err != nil {
+		t.Errorf(`wanted no row filters, got "%v", "%v"`, got, err)
+	}
+}
+
+func TestUpsertStatement(t *testing.T) {
+	table := &Table{Name: "T", PrimaryKey: Columns{"ID"}}
+	columns := []string{"ID", "NAME", "TENANT_ID"}
+	rowFilters := map[string]any{"TENANT_ID": "42"}
+	testCases := map[gosqlcrud.DbType]string{
+		gosqlcrud.PostgreSQL: "INSERT INTO T (ID, NAME, TENANT_ID) VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT (ID) DO UPDATE SET NAME = excluded.NAME WHERE T.TENANT_ID = excluded.TENANT_ID",
+		gosqlcrud.MySQL:      "INSERT INTO T (ID, NAME, TENANT_ID) VALUES (?, ?, ?), (?, ?, ?) ON DUPLICATE KEY UPDATE NAME = IF(TENANT_ID = VALUES(TENANT_ID), VALUES(NAME), NAME)",
+		gosqlcrud.SQLServer:  "MERGE INTO T AS tgt USING (VALUES (@p1, @p2, @p3), (@p4, @p5, @p6)) AS src (ID, NAME, TENANT_ID) ON (tgt.ID = src.ID) WHEN MATCHED AND tgt.TENANT_ID = src.TENANT_ID THEN UPDATE SET tgt.NAME = src.NAME WHEN NOT MATCHED THEN INSERT (ID, NAME, TENANT_ID) VALUES (src.ID, src.NAME, src.TENANT_ID);",
+		gosqlcrud.Oracle:     "MERGE INTO T tgt USING (SELECT :1 AS ID, :2 AS NAME, :3 AS TENANT_ID FROM dual UNION ALL SELECT :4 AS ID, :5 AS NAME, :6 AS TENANT_ID FROM dual) src ON (tgt.ID = src.ID) WHEN MATCHED THEN UPDATE SET tgt.NAME = src.NAME WHERE tgt.TENANT_ID = src.TENANT_ID WHEN NOT MATCHED THEN INSERT (ID, NAME, TENANT_ID) VALUES (src.ID, src.NAME, src.TENANT_ID)",
+	}
+	for dbType, want := range testCases {
+		database := &Database{dbType: dbType}
+		got, err := database.upsertStatement(table, columns, 2, rowFilters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf(`%v; wanted "%s", got "%s"`, dbType, want, got)
+		}
+	}
+
+	database := &Database{dbType: gosqlcrud.SQLite}
+	got, err := database.upsertStatement(&Table{Name: "T", ConflictColumns: []string{"CODE"}}, []string{"CODE"}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO T (CODE) VALUES (?) ON CONFLICT (CODE) DO NOTHING"; got != want {
+		t.Errorf(`wanted "%s", got "%s"`, want, got)
+	}
+	if _, err := database.upsertStatement(table, []string{"NAME"}, 1, nil); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for missing conflict column, got "%v"`, err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	table := &Table{}
+	err := json.Unmarshal([]byte(`{"primary_key": "ORDER_ID, LINE_NO"}`), table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := map[string][]any{
+		"10,3":                   {"10", "3"},
+		"ORDER_ID=10;LINE_NO=3":  {"10", "3"},
+		";line_no=3;order_id=10": {"10", "3"},
+		"":                       nil,
+	}
+	for key, want := range testCases {
+		got, err := table.ParseKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf(`%s; wanted "%v", got "%v"`, key, want, got)
+		}
+	}
+	for _, key := range []string{"10", "10,3,1", "ORDER_ID=10"} {
+		if _, err := table.ParseKey(key); errorStatus(err, 0) != http.StatusBadRequest {
+			t.Errorf(`%s; wanted bad request, got "%v"`, key, err)
+		}
+	}
+
+	table = &Table{PrimaryKey: Columns{"ID"}}
+	if got, _ := table.ParseKey("a,b"); !reflect.DeepEqual(got, []any{"a,b"}) {
+		t.Errorf(`wanted "[a,b]", got "%v"`, got)
+	}
+}
+
+func TestWrittenKey(t *testing.T) {
+	table := &Table{PrimaryKey: Columns{"ORDER_ID", "LINE_NO"}}
+	testCases := []struct {
+		key    []any
+		params map[string]any
+		result map[string]int64
+		want   []any
+	}{
+		{nil, map[string]any{"order_id": 1, "line_no": 2, "qty": 3}, map[string]int64{"rows_affected": 1}, []any{1, 2}},
+		{[]any{1, 2}, map[string]any{"line_no": 5}, map[string]int64{"rows_affected": 1}, []any{1, 5}},
+		{[]any{1, 2}, map[string]any{"qty": 3}, map[string]int64{"rows_affected": 0}, nil},
+	}
+	for _, testCase := range testCases {
+		got, err := writtenKey(table, testCase.key, testCase.params, testCase.result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, testCase.want) {
+			t.Errorf(`wanted "%v", got "%v"`, testCase.want, got)
+		}
+	}
+
+	table = &Table{PrimaryKey: Columns{"ID"}}
+	got, err := writtenKey(table, nil, map[string]any{"name": "a"}, map[string]int64{"rows_affected": 1, "last_insert_id": 7})
+	if err != nil || !reflect.DeepEqual(got, []any{int64(7)}) {
+		t.Errorf(`wanted "[7]", got "%v", "%v"`, got, err)
+	}
+	if _, err := writtenKey(table, nil, map[string]any{"name": "a"}, map[string]int64{"rows_affected": 1}); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request without a key, got "%v"`, err)
+	}
+}
+
+func TestKeysetWhere(t *testing.T) {
+	table := &Table{PrimaryKey: Columns{"ID"}}
+	order, err := parseOrderBy("CREATED_AT desc, NAME")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order = table.keysetOrder(order)
+	database := &Database{dbType: gosqlcrud.PostgreSQL}
+	if got, want := database.orderByClause(order), "ORDER BY CREATED_AT DESC, NAME ASC, ID ASC"; got != want {
+		t.Errorf(`wanted "%s", got "%s"`, want, got)
+	}
+
+	where, values := database.keysetWhere(order, []any{"2024-01-01", "a", 7}, 1)
+	wantWhere := " AND ((CREATED_AT < $2) OR (CREATED_AT = $3 AND (NAME > $4 OR NAME IS NULL)) OR (CREATED_AT = $5 AND NAME = $6 AND ID > $7))"
+	if where != wantWhere {
+		t.Errorf(`wanted "%s", got "%s"`, wantWhere, where)
+	}
+	wantValues := []any{"2024-01-01", "2024-01-01", "a", "2024-01-01", "a", 7}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf(`wanted "%v", got "%v"`, wantValues, values)
+	}
+
+	// NULLs are last in ascending order on PostgreSQL, so only the rows with
+	// the same NULL follow a NULL
+	where, values = database.keysetWhere(order, []any{"2024-01-01", nil, 7}, 1)
+	wantWhere = " AND ((CREATED_AT < $2) OR (CREATED_AT = $3 AND NAME IS NULL AND ID > $4))"
+	if where != wantWhere || !reflect.DeepEqual(values, []any{"2024-01-01", "2024-01-01", 7}) {
+		t.Errorf(`wanted "%s", got "%s", %v`, wantWhere, where, values)
+	}
+	// and first on SQLite, so all the other values follow a NULL
+	sqliteOrder := table.keysetOrder(order[1:])
+	where, _ = (&Database{dbType: gosqlcrud.SQLite}).keysetWhere(sqliteOrder, []any{nil, 7}, 0)
+	if wantWhere := " AND ((NAME IS NOT NULL) OR (NAME IS NULL AND ID > ?))"; where != wantWhere {
+		t.Errorf(`wanted "%s", got "%s"`, wantWhere, where)
+	}
+	lastOrder, err := parseOrderBy("NAME NULLS LAST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, _ = (&Database{dbType: gosqlcrud.SQLite}).keysetWhere(table.keysetOrder(lastOrder), []any{"a", 7}, 0)
+	if wantWhere := " AND ((NAME > ? OR NAME IS NULL) OR (NAME = ? AND ID > ?))"; where != wantWhere {
+		t.Errorf(`wanted "%s", got "%s"`, wantWhere, where)
+	}
+
+	key := bytes.Repeat([]byte{1}, 32)
+	cursor, err := encodeCursor(key, order, map[string]any{"created_at": "2024-01-01", "name": "a", "id": int64(7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the values are sealed
+	if sealed, _ := base64.RawURLEncoding.DecodeString(cursor); bytes.Contains(sealed, []byte("2024-01-01")) {
+		t.Errorf(`cursor %s is readable`, sealed)
+	}
+	cursorValues, err := decodeCursor(key, cursor, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []any{"2024-01-01", "a", int64(7)}; !reflect.DeepEqual(cursorValues, want) {
+		t.Errorf(`wanted "%v", got "%v"`, want, cursorValues)
+	}
+	if _, err := decodeCursor(key, cursor, order[1:]); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for another order, got "%v"`, err)
+	}
+	if _, err := decodeCursor(bytes.Repeat([]byte{2}, 32), cursor, order); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for another key, got "%v"`, err)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"o":"created_at,name,id","v":["2024-01-01","a",7]}`))
+	if _, err := decodeCursor(key, forged, order); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for a forged cursor, got "%v"`, err)
+	}
+	if _, err := parseOrderBy("NAME; DROP TABLE T"); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for invalid order, got "%v"`, err)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	order, err := parseOrderBy("-created_at.nullslast, name asc nulls first,+id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := map[gosqlcrud.DbType]string{
+		gosqlcrud.PostgreSQL: "ORDER BY created_at DESC NULLS LAST, name ASC NULLS FIRST, id ASC",
+		gosqlcrud.Oracle:     "ORDER BY created_at DESC NULLS LAST, name ASC NULLS FIRST, id ASC",
+		gosqlcrud.MySQL:      "ORDER BY CASE WHEN created_at IS NULL THEN 1 ELSE 0 END, created_at DESC, CASE WHEN name IS NULL THEN 0 ELSE 1 END, name ASC, id ASC",
+		gosqlcrud.SQLServer:  "ORDER BY CASE WHEN created_at IS NULL THEN 1 ELSE 0 END, created_at DESC, CASE WHEN name IS NULL THEN 0 ELSE 1 END, name ASC, id ASC",
+	}
+	for dbType, want := range testCases {
+		database := &Database{dbType: dbType}
+		if got := database.orderByClause(order); got != want {
+			t.Errorf(`%v; wanted "%s", got "%s"`, dbType, want, got)
+		}
+	}
+
+	for _, orderBy := range []string{"name nulls", "name.up", "-", "LOWER(name)", "name desc asc x"} {
+		if _, err := parseOrderBy(orderBy); errorStatus(err, 0) != http.StatusBadRequest {
+			t.Errorf(`%s; wanted bad request, got "%v"`, orderBy, err)
+		}
+	}
+
+	table := &Table{ExportedColumns: []string{"ID", "NAME AS USERNAME"}}
+	database := &Database{dbType: gosqlcrud.SQLite}
+	if err := database.checkOrder(table, order[1:], nil); err != nil {
+		t.Error(err)
+	}
+	if err := database.checkOrder(table, order, nil); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for a column not exported, got "%v"`, err)
+	}
+	if err := database.checkOrder(table, order[1:], []string{"ID"}); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for a column not readable, got "%v"`, err)
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	table := &Table{}
+	database := &Database{dbType: gosqlcrud.SQLite}
+	columns, err := database.selectColumns(table, "id, full_name:name,", []string{"ID", "NAME AS USERNAME"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"id", "name AS full_name"}; !slices.Equal(columns, want) {
+		t.Errorf(`wanted %v, got %v`, want, columns)
+	}
+	columns, err = database.selectColumns(table, "name", []string{"ID", "NAME AS USERNAME"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"NAME AS USERNAME"}; !slices.Equal(columns, want) {
+		t.Errorf(`wanted %v, got %v`, want, columns)
+	}
+
+	for _, selectParam := range []string{"", "email", "full_name:", "a b:name", "LOWER(name)", "x:id:name"} {
+		if _, err := database.selectColumns(table, selectParam, []string{"ID", "NAME"}); errorStatus(err, 0) != http.StatusBadRequest {
+			t.Errorf(`%s; wanted bad request, got "%v"`, selectParam, err)
+		}
+	}
+}
+
+func TestForeignKeyWhere(t *testing.T) {
+	keys := [][]any{{1, "a"}, {2, "b"}}
+	testCases := map[gosqlcrud.DbType]string{
+		gosqlcrud.PostgreSQL: "((ORDER_ID = $1 AND REGION = $2) OR (ORDER_ID = $3 AND REGION = $4))",
+		gosqlcrud.MySQL:      "((ORDER_ID = ? AND REGION = ?) OR (ORDER_ID = ? AND REGION = ?))",
+	}
+	for dbType, want := range testCases {
+		database := &Database{dbType: dbType}
+		got, values := database.foreignKeyWhere(Columns{"ORDER_ID", "REGION"}, keys)
+		if got != want {
+			t.Errorf(`%v; wanted "%s", got "%s"`, dbType, want, got)
+		}
+		if !reflect.DeepEqual(values, []any{1, "a", 2, "b"}) {
+			t.Errorf(`%v; wrong values %v`, dbType, values)
+		}
+	}
+
+	database := &Database{dbType: gosqlcrud.SQLServer}
+	if got, _ := database.foreignKeyWhere(Columns{"ORDER_ID"}, keys); got != "ORDER_ID IN (@p1, @p2)" {
+		t.Errorf(`wanted IN condition, got "%s"`, got)
+	}
+}
+
+func TestParseGrouping(t *testing.T) {
+	database := &Database{dbType: gosqlcrud.SQLite}
+	table := &Table{}
+	g, err := database.parseGrouping(table, "status, region", "count(*), SUM(amount), average:avg( price )", []string{"STATUS", "REGION", "AMOUNT", "PRICE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "status, region, COUNT(*) AS count, SUM(amount) AS sum_amount, AVG(price) AS average"; g.columns() != want {
+		t.Errorf(`wanted "%s", got "%s"`, want, g.columns())
+	}
+	if want := "GROUP BY status, region"; g.groupByClause() != want {
+		t.Errorf(`wanted "%s", got "%s"`, want, g.groupByClause())
+	}
+	order, _ := parseOrderBy("-sum_amount,status")
+	if err := g.checkOrder(order); err != nil {
+		t.Error(err)
+	}
+	order, _ = parseOrderBy("amount")
+	if err := g.checkOrder(order); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for a column not grouped, got "%v"`, err)
+	}
+
+	for _, aggregate := range []string{"sum(*)", "sum(cost)", "median(price)", "sum(amount) x", "sum(amount);", "a b:sum(amount)", "sum(amount+price)"} {
+		if _, err := database.parseGrouping(table, "", aggregate, []string{"AMOUNT", "PRICE"}); errorStatus(err, 0) != http.StatusBadRequest {
+			t.Errorf(`%s; wanted bad request, got "%v"`, aggregate, err)
+		}
+	}
+}
+
+func TestResponseFormat(t *testing.T) {
+	testCases := []struct {
+		format string
+		accept string
+		want   string
+	}{
+		{"", "", formatJSON},
+		{"", "text/html, text/csv;q=0.9", formatCSV},
+		{"", "application/x-ndjson", formatNDJSON},
+		{"", "*/*", formatJSON},
+		{"XLSX", "text/csv", formatXLSX},
+	}
+	for _, testCase := range testCases {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		if testCase.accept != "" {
+			r.Header.Set("Accept", testCase.accept)
+		}
+		params := map[string]any{}
+		if testCase.format != "" {
+			params[".format"] = testCase.format
+		}
+		if got, err := responseFormat(r, params); err != nil || got != testCase.want {
+			t.Errorf(`%v; wanted %s, got %s, %v`, testCase, testCase.want, got, err)
+		}
+	}
+}
+
+func TestWriteSections(t *testing.T) {
+	result := map[string]any{
+		"orders": []map[string]any{{"id": int64(1), "note": "a, \"b\"", "total": 1.5}, {"id": int64(2), "note": nil}},
+		"count":  map[string]int64{"rows_affected": 2},
+	}
+	sections := resultSections(context.Background(), "report", "", result, true, false)
+
+	var csvBuf bytes.Buffer
+	if err := writeCSV(&csvBuf, sections); err != nil {
+		t.Fatal(err)
+	}
+	want := "count\nrows_affected\n2\n\norders\nid,note,total\n1,\"a, \"\"b\"\"\",1.5\n2,,\n"
+	if got := csvBuf.String(); got != want {
+		t.Errorf(`wanted %q, got %q`, want, got)
+	}
+
+	var ndjsonBuf bytes.Buffer
+	if err := writeNDJSON(&ndjsonBuf, resultSections(context.Background(), "orders", "", result["orders"], false, true)); err != nil {
+		t.Fatal(err)
+	}
+	want = "{\"id\":1,\"note\":\"a, \\\"b\\\"\",\"total\":1.5}\n{\"id\":2,\"note\":null}\n"
+	if got := ndjsonBuf.String(); got != want {
+		t.Errorf(`wanted %q, got %q`, want, got)
+	}
+
+	// the columns follow the order of the query, then the others sorted
+	ctx := withColumnOrder(context.Background())
+	setQueryColumns(ctx, "orders list", []string{"total", "cursor", "id"})
+	csvBuf.Reset()
+	if err := writeCSV(&csvBuf, resultSections(ctx, "orders", "orders list", result["orders"], false, true)); err != nil {
+		t.Fatal(err)
+	}
+	want = "total,id,note\n1.5,1,\"a, \"\"b\"\"\"\n,2,\n"
+	if got := csvBuf.String(); got != want {
+		t.Errorf(`wanted %q, got %q`, want, got)
+	}
+
+	var xlsxBuf bytes.Buffer
+	if err := writeXLSX(&xlsxBuf, sections); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(xlsxBuf.Bytes()), int64(xlsxBuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workbook := readZipFile(z, "xl/workbook.xml")
+	for _, sheet := range []string{`<sheet name="count" sheetId="1"`, `<sheet name="orders" sheetId="2"`} {
+		if !strings.Contains(workbook, sheet) {
+			t.Errorf(`sheet %s not found in %s`, sheet, workbook)
+		}
+	}
+	if sheet := readZipFile(z, "xl/worksheets/sheet2.xml"); !strings.Contains(sheet, `<row r="2"><c r="A2"><v>1</v></c><c r="B2" t="inlineStr"><is><t xml:space="preserve">a, &#34;b&#34;</t></is></c><c r="C2"><v>1.5</v></c></row>`) {
+		t.Errorf(`unexpected sheet %s`, sheet)
+	}
+
+	if got := columnName(27); got != "AB" {
+		t.Errorf(`wanted AB, got %s`, got)
+	}
+}
+
+func TestRowScanner(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// blobs are scanned as bytes, as drivers return decimals
+	_, err = db.Exec(`CREATE TABLE D (N DECIMAL(10,2), I BIGINT, S TEXT, X TEXT); INSERT INTO D VALUES (X'312E3530', X'3132', X'6162', NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT N, I, S, X FROM D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	scanner, err := newRowScanner(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	row, err := scanner.scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]any{"n": 1.5, "i": int64(12), "s": "ab", "x": nil}; !reflect.DeepEqual(row, want) {
+		t.Errorf("row = %#v, want %#v", row, want)
+	}
+	if want := []string{"n", "i", "s", "x"}; !slices.Equal(scanner.columns, want) {
+		t.Errorf("columns = %v, want %v", scanner.columns, want)
+	}
+}
+
+func TestRowStreamer(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE T (ID INTEGER, NAME VARCHAR(10)); INSERT INTO T VALUES (1, 'a'), (2, 'b,c')`); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		formatJSON:   `{"rows":[{"id":1,"name":"a"},{"id":2,"name":"b,c"}],"count":{"rows_affected":2}}` + "\n",
+		formatNDJSON: `{"rows":{"id":1,"name":"a"}}` + "\n" + `{"rows":{"id":2,"name":"b,c"}}` + "\n" + `{"count":{"rows_affected":2}}` + "\n",
+		formatCSV:    "rows\nid,name\n1,a\n2,\"b,c\"\n\ncount\nrows_affected\n2\n",
+	}
+	for format, want := range testCases {
+		w := httptest.NewRecorder()
+		stream, err := newRowStreamer(w, format, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.labeled = true
+		if err := stream.query(db, "rows", "SELECT * FROM T ORDER BY ID"); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.result("count", map[string]int64{"rows_affected": 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.finish(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Body.String(); got != want {
+			t.Errorf(`%s; wanted %q, got %q`, format, want, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != formatContentTypes[format] {
+			t.Errorf(`%s; wrong content type %s`, format, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	stream, _ := newRowStreamer(w, formatJSON, 1)
+	if err := stream.query(db, "", "SELECT * FROM T"); err == nil || !stream.started() {
+		t.Errorf(`wanted an error after the response started, got "%v"`, err)
+	}
+	if _, err := newRowStreamer(w, formatXLSX, 1); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for xlsx, got "%v"`, err)
+	}
+}
+
+func TestImportReaders(t *testing.T) {
+	csvReader, err := newCSVImportReader(strings.NewReader("\ufeffID,NAME\n1,NULL\n2\n\"3\",\"a\nb\"\n"), []string{"ID", "NAME"}, "NULL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wants := []struct {
+		line int
+		row  map[string]any
+		err  bool
+	}{
+		{2, map[string]any{"ID": "1", "NAME": nil}, false},
+		{3, nil, true},
+		{4, map[string]any{"ID": "3", "NAME": "a\nb"}, false},
+	}
+	for _, want := range wants {
+		line, row, err := csvReader.next()
+		if line != want.line || !reflect.DeepEqual(row, want.row) || (err != nil) != want.err {
+			t.Errorf(`wanted %v, got %d %v %v`, want, line, row, err)
+		}
+	}
+	if _, _, err := csvReader.next(); err != io.EOF {
+		t.Errorf(`wanted EOF, got "%v"`, err)
+	}
+	if _, err := newCSVImportReader(strings.NewReader("ID,PRICE\n"), []string{"ID", "NAME"}, nil); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Errorf(`wanted bad request for an unknown column, got "%v"`, err)
+	}
+
+	ndjsonReader := &ndjsonImportReader{reader: bufio.NewReader(strings.NewReader("{\"id\": 1}\n\n[1]\n{\"id\": 2}"))}
+	for _, want := range []int{1, 3, 4} {
+		if line, _, err := ndjsonReader.next(); line != want || (err != nil) != (want == 3) {
+			t.Errorf(`wanted line %d, got %d, %v`, want, line, err)
+		}
+	}
+	if _, _, err := ndjsonReader.next(); err != io.EOF {
+		t.Errorf(`wanted EOF, got "%v"`, err)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	app := &App{Databases: map[string]*Database{}, metrics: newMetrics()}
+	app.metrics.observeRequest(requestLabels{db: "db", object: "a\"b", method: "GET", status: "200"}, 20*time.Millisecond)
+	app.metrics.observeRequest(requestLabels{db: "db", object: "a\"b", method: "GET", status: "200"}, 2*time.Second)
+	app.metrics.authFailure(authNotAllowed)
+	app.metrics.tokenCacheLookup(true)
+	app.metrics.tokenCacheLookup(false)
+	app.metrics.tokenCacheLookup(false)
+
+	var b strings.Builder
+	app.writeMetrics(&b)
+	metrics := b.String()
+	labels := `db="db",object="a\"b",method="GET",status="200"`
+	for _, line := range []string{
+		"# TYPE gosqlapi_request_duration_seconds histogram",
+		"gosqlapi_requests_total{" + labels + "} 2",
+		"gosqlapi_request_duration_seconds_bucket{" + labels + `,le="0.01"} 0`,
+		"gosqlapi_request_duration_seconds_bucket{" + labels + `,le="0.025"} 1`,
+		"gosqlapi_request_duration_seconds_bucket{" + labels + `,le="2.5"} 2`,
+		"gosqlapi_request_duration_seconds_bucket{" + labels + `,le="+Inf"} 2`,
+		"gosqlapi_request_duration_seconds_sum{" + labels + "} 2.02",
+		"gosqlapi_request_duration_seconds_count{" + labels + "} 2",
+		`gosqlapi_auth_failures_total{reason="not_allowed"} 1`,
+		"gosqlapi_token_cache_hits_total 1",
+		"gosqlapi_token_cache_misses_total 2",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics missing %q in:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	app := &App{Web: &Web{}, accessLogger: slog.New(slog.NewJSONHandler(&buf, nil))}
+	r := httptest.NewRequest(http.MethodGet, "/db/items", nil)
+	r.SetPathValue("db", "db")
+	r.SetPathValue("obj", "items")
+	r.Header.Set("Authorization", "Bearer secret-token")
+	r.Header.Set("X-Request-Id", "abc-123")
+	recorder := &responseRecorder{ResponseWriter: httptest.NewRecorder(), requestId: requestId(r)}
+	recorder.WriteHeader(http.StatusCreated)
+	setRows(recorder, 3)
+	app.finishRequest(recorder, r, time.Now())
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"request_id": "abc-123",
+		"db":         "db",
+		"object":     "items",
+		"method":     "GET",
+		"status":     float64(201),
+		"rows":       float64(3),
+		"token":      tokenFingerprint("secret-token"),
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+	if strings.Contains(buf.String(), "secret-token") || entry["token"] == "" {
+		t.Errorf("token fingerprint %v", entry["token"])
+	}
+
+	r.Header.Set("X-Request-Id", "bad id\n")
+	if id := requestId(r); id == "bad id\n" || id == "" {
+		t.Errorf("requestId = %q", id)
+	}
+}
+
+func TestCountRows(t *testing.T) {
+	tests := []struct {
+		result any
+		script bool
+		list   bool
+		want   int64
+	}{
+		{nil, false, false, 0},
+		{[]map[string]any{{"a": 1}, {"a": 2}}, true, false, 2},
+		{map[string]int64{"rows_affected": 4}, false, false, 4},
+		{map[string]any{"data": []map[string]any{{"a": 1}}, "total": 10}, false, true, 1},
+		{map[string]any{"id": 1}, false, false, 1},
+		{map[string]any{"rows_affected": int64(5)}, false, false, 5},
+		{map[string]any{"a": []map[string]any{{"a": 1}}, "b": map[string]int64{"rows_affected": 2}}, true, false, 3},
+	}
+	for _, test := range tests {
+		if got := countRows(test.result, test.script, test.list); got != test.want {
+			t.Errorf("countRows(%v) = %d, want %d", test.result, got, test.want)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.log")
+	file, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		b, err := os.ReadFile(path + name)
+		if err != nil || string(b) != want {
+			t.Errorf("slow.log%s = %q, %v, want %q", name, b, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("slow.log.3 is kept")
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	dir := t.TempDir()
+	database := &Database{id: "db", Type: "sqlite", Url: filepath.Join(dir, "test.db")}
+	db, err := database.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE SLOW_QUERIES (DB TEXT, LABEL TEXT, SQL_TEXT TEXT, PARAMS TEXT, DURATION_MS REAL, ROW_COUNT INTEGER, CREATED_AT TEXT)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{
+		Databases: map[string]*Database{"db": database},
+		SlowQuery: &SlowQuery{Threshold: 1, File: filepath.Join(dir, "slow.log"), Database: "db", Table: "SLOW_QUERIES"},
+	}
+	if err := app.buildSlowQueryLog(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer app.slowQueryLog.close(nil)
+	// log every statement
+	database.slowThreshold = time.Nanosecond
+
+	// request parameters are logged as parameters, not in the SQL
+	template := &statementTemplate{sql: "SELECT ? AS X, !authorization! AS T", params: []string{"!authorization!"}, values: []any{"Bearer s3cret"}}
+	ctx := withStatementTemplate(context.Background(), template)
+	data, err := database.queryToMaps(ctx, db, "secret", []string{"password"}, "SELECT ? AS X, 'Bearer s3cret' AS T", "hunter2")
+	if err != nil || len(data) != 1 {
+		t.Fatal(data, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "slow.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["db"] != "db" || entry["label"] != "secret" || entry["sql"] != template.sql || entry["rows"] != float64(1) {
+		t.Errorf("entry = %v", entry)
+	}
+	if !reflect.DeepEqual(entry["params"], []any{"password", "!authorization!"}) || strings.Contains(string(b), "hunter2") || strings.Contains(string(b), "s3cret") {
+		t.Errorf("params = %v, values = %v", entry["params"], entry["values"])
+	}
+
+	var rows []map[string]any
+	for range 100 {
+		rows, err = gosqlcrud.QueryToMaps(db, "SELECT LABEL, SQL_TEXT, PARAMS, ROW_COUNT FROM SLOW_QUERIES")
+		if err != nil || len(rows) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || len(rows) != 1 || rows[0]["label"] != "secret" || strings.Contains(fmt.Sprint(rows[0]), "hunter2") || strings.Contains(fmt.Sprint(rows[0]), "s3cret") {
+		t.Errorf("slow query table = %v, %v", rows, err)
+	}
+
+	// with log_params, the values of request parameters are logged
+	app.SlowQuery.LogParams = true
+	if _, err := database.queryToMaps(ctx, db, "secret", []string{"password"}, "SELECT ? AS X, 'Bearer s3cret' AS T", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(filepath.Join(dir, "slow.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry["values"], []any{"hunter2", "Bearer s3cret"}) {
+		t.Errorf("values = %v", entry["values"])
+	}
+
+	// close writes the queued entries and stops the worker
+	app.slowQueryLog.close(nil)
+	rows, err = gosqlcrud.QueryToMaps(db, "SELECT LABEL FROM SLOW_QUERIES")
+	if err != nil || len(rows) != 2 {
+		t.Errorf("slow query table = %v, %v", rows, err)
+	}
+	// statements logged after close do not block
+	if _, err := database.queryToMaps(ctx, db, "secret", nil, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are dropped when the queue is full
+	slowLog := &slowQueryLog{config: app.SlowQuery, logger: slog.New(slog.NewJSONHandler(io.Discard, nil)), table: database, entries: make(chan *slowQueryEntry, 1)}
+	for range 3 {
+		slowLog.log("db", "secret", "SELECT 1", nil, nil, time.Second, 1)
+	}
+	if len(slowLog.entries) != 1 || slowLog.dropped.Load() != 2 {
+		t.Errorf("queued = %d, dropped = %d", len(slowLog.entries), slowLog.dropped.Load())
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceId, spanId, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || !sampled || hex.EncodeToString(traceId[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(spanId[:]) != "00f067aa0ba902b7" {
+		t.Errorf("parseTraceparent = %x, %x, %v, %v", traceId, spanId, sampled, ok)
+	}
+	if _, _, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !ok || sampled {
+		t.Errorf("not sampled = %v, %v", sampled, ok)
+	}
+	for _, header := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, _, _, ok := parseTraceparent(header); ok {
+			t.Errorf("parseTraceparent(%q) is valid", header)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer collector.Close()
+	tr := newTracer(&Tracing{Endpoint: collector.URL + "/v1/traces"}, nil)
+	defer tr.stop()
+
+	database := &Database{Type: "sqlite", Url: ":memory:", id: "db"}
+	db, err := database.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/db/items", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, serverSpan := tr.startServerSpan(r, "GET /{db}/{obj}")
+	// the statement is traced with the SQL before the request parameters are replaced
+	if _, err := database.queryToMaps(withStatementTemplate(ctx, &statementTemplate{sql: "SELECT !authorization! AS X", params: []string{"!authorization!"}, values: []any{"secret"}}), db, "items", nil, "SELECT 'secret' AS X"); err != nil {
+		t.Fatal(err)
+	}
+	database.queryToMaps(ctx, db, "broken", nil, "SELECT FROM")
+	finishServerSpan(serverSpan, http.StatusOK)
+	tr.flush()
+
+	var body map[string]any
+	if err := json.Unmarshal(<-bodies, &body); err != nil {
+		t.Fatal(err)
+	}
+	spans := body["resourceSpans"].([]any)[0].(map[string]any)["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	if len(spans) != 3 {
+		t.Fatalf("spans = %v", spans)
+	}
+	server := spans[2].(map[string]any)
+	if server["name"] != "GET /{db}/{obj}" || server["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || server["parentSpanId"] != "00f067aa0ba902b7" || server["kind"] != float64(spanKindServer) {
+		t.Errorf("server span = %v", server)
+	}
+	statement := spans[0].(map[string]any)
+	if statement["name"] != "items" || statement["traceId"] != server["traceId"] || statement["parentSpanId"] != server["spanId"] {
+		t.Errorf("statement span = %v", statement)
+	}
+	attributes := map[string]any{}
+	for _, attribute := range statement["attributes"].([]any) {
+		a := attribute.(map[string]any)
+		attributes[a["key"].(string)] = a["value"]
+	}
+	if !reflect.DeepEqual(attributes["db.system"], map[string]any{"stringValue": "sqlite"}) ||
+		!reflect.DeepEqual(attributes["gosqlapi.statement.label"], map[string]any{"stringValue": "items"}) ||
+		!reflect.DeepEqual(attributes["db.query.text"], map[string]any{"stringValue": "SELECT !authorization! AS X"}) ||
+		!reflect.DeepEqual(attributes["gosqlapi.statement.rows"], map[string]any{"intValue": "1"}) {
+		t.Errorf("statement attributes = %v", attributes)
+	}
+	if status, _ := spans[1].(map[string]any)["status"].(map[string]any); status["code"] != float64(2) {
+		t.Errorf("failed statement status = %v", status)
+	}
+
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if _, s := tr.startServerSpan(r, "GET /{db}/{obj}"); s != nil {
+		t.Errorf("unsampled request is traced")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	app := &App{Web: &Web{MaxTimeout: 30}}
+	database := &Database{Timeout: 10}
+	tests := []struct {
+		objectTimeout int
+		params        map[string]any
+		want          time.Duration
+	}{
+		{0, map[string]any{}, 10 * time.Second},
+		{5, map[string]any{}, 5 * time.Second},
+		{5, map[string]any{".timeout": "0.5"}, 500 * time.Millisecond},
+		{5, map[string]any{".timeout": "20"}, 20 * time.Second},
+		{5, map[string]any{".timeout": 60}, 30 * time.Second},
+	}
+	for _, test := range tests {
+		got, err := app.requestTimeout(database, test.objectTimeout, test.params)
+		if err != nil || got != test.want {
+			t.Errorf("requestTimeout(%d, %v) = %v, %v, want %v", test.objectTimeout, test.params, got, err, test.want)
+		}
+	}
+	if timeout, _ := app.requestTimeout(&Database{}, 0, map[string]any{}); timeout != 0 {
+		t.Errorf("timeout without settings = %v", timeout)
+	}
+	for _, timeout := range []any{"abc", "0", -1} {
+		if _, err := app.requestTimeout(database, 0, map[string]any{".timeout": timeout}); errorStatus(err, 0) != http.StatusBadRequest {
+			t.Errorf("requestTimeout(.timeout=%v) = %v", timeout, err)
+		}
+	}
+}
+
+func TestContextError(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = gosqlcrud.QueryToMaps(withContext(ctx, db), "WITH RECURSIVE C(X) AS (SELECT 1 UNION ALL SELECT X + 1 FROM C WHERE X < 1000000000) SELECT COUNT(*) AS N FROM C")
+	err = contextError(ctx, err, 50*time.Millisecond)
+	if errorStatus(err, 0) != http.StatusGatewayTimeout {
+		t.Errorf("timed out query = %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = gosqlcrud.QueryToMaps(withContext(ctx, db), "SELECT 1")
+	if errorStatus(contextError(ctx, err, 0), 0) != statusClientClosedRequest {
+		t.Errorf("canceled query = %v", err)
+	}
+	if err := contextError(context.Background(), io.EOF, 0); err != io.EOF {
+		t.Errorf("contextError = %v", err)
+	}
+}
+
+// failingConn fails the statements matched by fail.
+type failingConn struct {
+	gosqlcrud.DB
+	fail     func(q string, args []any) bool
+	executed []string
+}
+
+func (this *failingConn) Exec(q string, args ...any) (sql.Result, error) {
+	this.executed = append(this.executed, q)
+	if this.fail(q, args) {
+		return nil, fmt.Errorf("statement failed")
+	}
+	return this.DB.Exec(q, args...)
+}
+
+func TestInsertRowsRetry(t *testing.T) {
+	database := &Database{Type: "sqlite", Url: ":memory:"}
+	db, err := database.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE T (ID INTEGER PRIMARY KEY, NAME TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	table := &Table{Name: "T", PrimaryKey: Columns{"ID"}}
+	multiRow := func(q string, args []any) bool {
+		return strings.HasPrefix(q, "INSERT") && strings.Contains(q, "), (")
+	}
+	rows := func(names ...string) []any {
+		ret := []any{}
+		for _, name := range names {
+			ret = append(ret, map[string]any{"ID": len(ret) + 1, "NAME": name})
+		}
+		return ret
+	}
+
+	// the rows are inserted one by one when the multi-row statement fails
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &failingConn{DB: tx, fail: multiRow}
+	result, err := insertRows(context.Background(), conn, database, table, rows("a", "b", "c"), false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["rows_affected"] != int64(3) || !reflect.DeepEqual(result["keys"], []any{1, 2, 3}) {
+		t.Errorf("result = %v", result)
+	}
+	// the savepoint of the batch is released once it is inserted
+	if got := conn.executed[len(conn.executed)-1]; got != "RELEASE SAVEPOINT bulk_insert" {
+		t.Errorf("last statement = %s", got)
+	}
+	tx.Rollback()
+
+	// only the row that fails on its own is blamed
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = insertRows(context.Background(), &failingConn{DB: tx, fail: func(q string, args []any) bool {
+		return multiRow(q, args) || slices.Contains(args, any("bad"))
+	}}, database, table, rows("a", "bad", "c"), false, nil, nil)
+	var rowError *RowError
+	if !errors.As(err, &rowError) || rowError.Index != 1 {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+%s</Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets>%s</sheets>
+</workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+%s</Relationships>`
+
+// writeXLSX writes sections as a workbook with a sheet for each section. Cells
+// are written as inline strings, numbers and booleans, without styles.
+func writeXLSX(w io.Writer, sections []*section) error {
+	contentTypes := ""
+	sheets := ""
+	rels := ""
+	names := map[string]bool{}
+	for i, s := range sections {
+		n := i + 1
+		contentTypes += fmt.Sprintf(`<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`+"\n", n)
+		sheets += fmt.Sprintf(`<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(sheetName(s.name, n, names)), n, n)
+		rels += fmt.Sprintf(`<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`+"\n", n, n)
+	}
+
+	z := zip.NewWriter(w)
+	for _, part := range [][2]string{
+		{"[Content_Types].xml", fmt.Sprintf(xlsxContentTypes, contentTypes)},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, sheets)},
+		{"xl/_rels/workbook.xml.rels", fmt.Sprintf(xlsxWorkbookRels, rels)},
+	} {
+		f, err := z.Create(part[0])
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part[1]); err != nil {
+			return err
+		}
+	}
+	for i, s := range sections {
+		f, err := z.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := writeXLSXSheet(f, s); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// writeXLSXSheet writes the worksheet of s, with a header row of the columns.
+func writeXLSXSheet(w io.Writer, s *section) error {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	columns := sectionColumns(s)
+	header := make([]any, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	writeXLSXRow(&b, 1, header)
+	for i, row := range s.rows {
+		values := make([]any, len(columns))
+		for j, column := range columns {
+			values[j] = row[column]
+		}
+		writeXLSXRow(&b, i+2, values)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeXLSXRow(b *strings.Builder, rowNumber int, values []any) {
+	fmt.Fprintf(b, `<row r="%d">`, rowNumber)
+	for i, value := range values {
+		ref := columnName(i) + strconv.Itoa(rowNumber)
+		switch v := value.(type) {
+		case nil:
+			continue
+		case bool:
+			n := 0
+			if v {
+				n = 1
+			}
+			fmt.Fprintf(b, `<c r="%s" t="b"><v>%d</v></c>`, ref, n)
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			fmt.Fprintf(b, `<c r="%s"><v>%d</v></c>`, ref, v)
+		case float32, float64:
+			if f, _ := strconv.ParseFloat(fmt.Sprint(v), 64); !math.IsInf(f, 0) && !math.IsNaN(f) {
+				fmt.Fprintf(b, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(f, 'g', -1, 64))
+				continue
+			}
+			fmt.Fprintf(b, `<c r="%s" t="inlineStr"><is><t>%v</t></is></c>`, ref, v)
+		default:
+			fmt.Fprintf(b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xmlEscape(cellString(value)))
+		}
+	}
+	b.WriteString(`</row>`)
+}
+
+// columnName returns the name of the column at index i, A for 0, Z for 25 and
+// AA for 26.
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// sheetName returns a valid and unique sheet name for name, falling back to
+// SheetN when name is empty.
+func sheetName(name string, n int, names map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, strings.Trim(name, "'"))
+	if len([]rune(name)) > 31 {
+		name = string([]rune(name)[:31])
+	}
+	if name == "" || names[strings.ToLower(name)] {
+		name = fmt.Sprintf("Sheet%d", n)
+	}
+	names[strings.ToLower(name)] = true
+	return name
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}